@@ -15,7 +15,8 @@ import (
 func main() {
 	var help = flag.Bool("help", false, "print help")
 	var port = flag.Int("port", -1, "port to listen")
-	var gkArrd = flag.String("gatekeeper", "", "gatekeeper address")
+	var gkArrd = flag.String("gatekeeper", "", "gatekeeper addresses, comma separated for a sharded store")
+	var oldGkAddr = flag.String("old-gatekeeper", "", "gatekeeper addresses before the migration in progress, urls not found are looked up there")
 	var cgAddr = flag.String("caregiver", "", "caregiver address")
 	var vint = flag.Int("interval", 1, "sleep interval")
 	var pushCnt = flag.Int("push-cnt", 10, "urls to push to the caregiver at a time")
@@ -27,7 +28,7 @@ func main() {
 		return
 	}
 
-	sp, err := spider.NewSpider(*gkArrd, *cgAddr, time.Duration(*vint)*time.Second, uint(*pushCnt))
+	sp, err := spider.NewSpider(*gkArrd, *oldGkAddr, *cgAddr, time.Duration(*vint)*time.Second, uint(*pushCnt))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -4,8 +4,11 @@ import (
 	"net/url"
 	"psearch/crawler/caregiver"
 	"psearch/gatekeeper"
+	"psearch/gatekeeper/shard"
+	"psearch/util/errors"
 	"psearch/util/log"
 	"regexp"
+	"strings"
 	"sync"
 	"time"
 )
@@ -13,7 +16,7 @@ import (
 var urlRegex *regexp.Regexp = regexp.MustCompile(`<a\s.*?\s?href\s*?=\s*?['"]\s*?(?P<url>.+?)\s*?['"]`)
 
 type Spider struct {
-	gk        gatekeeper.GatekeeperClient
+	gk        *shard.Client
 	cg        caregiver.CaregiverClient
 	urls      caregiver.LockedQueue
 	waitUrls  map[string]struct{}
@@ -23,11 +26,14 @@ type Spider struct {
 	pushCnt   uint
 }
 
-func NewSpider(gk, cg string, interval time.Duration, pushCnt uint) (*Spider, error) {
-	gkc, err := gatekeeper.NewGatekeeperClient(gk)
-	if err != nil {
-		return nil, err
+// NewSpider takes the gatekeeper shards as a comma separated list, oldGk is
+// the shard map before a migration in progress, empty if there is none.
+func NewSpider(gk, oldGk, cg string, interval time.Duration, pushCnt uint) (*Spider, error) {
+	var old []string
+	if oldGk != "" {
+		old = strings.Split(oldGk, ",")
 	}
+	gkc := shard.NewClient(strings.Split(gk, ","), old)
 
 	cgc, err := caregiver.NewCaregiverClient(cg)
 	if err != nil {
@@ -83,12 +89,20 @@ func (self *Spider) RunPuller() error {
 
 		log.Printf("Spider.RunPuller(): pulled urls\n")
 
-		// запишем их в хранилище
-		toDel := []string{}
+		// запишем их в хранилище одним запросом
+		docs := make([]gatekeeper.WriteArgs, 0, len(urls))
 		for url, v := range urls {
-			_, err := self.gk.Write(url, v)
-			if err != nil {
-				toDel = append(toDel, url)
+			docs = append(docs, gatekeeper.WriteArgs{
+				FindArgs: gatekeeper.FindArgs{Url: url},
+				Body:     v,
+			})
+		}
+
+		toDel := []string{}
+		written, err := self.gk.WriteAll(docs)
+		for i, d := range docs {
+			if err != nil || written[i].Error != "" {
+				toDel = append(toDel, d.Url)
 			}
 		}
 
@@ -160,18 +174,46 @@ func (self *Spider) RunPuller() error {
 		// TODO: тут еще по robots.txt для хоста вычистить урлы
 
 		// проверим, есть ли такие урлы в хранилище, если есть, отменим их
+		toCheck := make([]int, 0, len(newUrls))
+		checkUrls := make([]string, 0, len(newUrls))
 		for i := 0; i < len(newUrls); i += 1 {
-			if newUrls[i] == "" {
-				continue
+			if newUrls[i] != "" {
+				toCheck = append(toCheck, i)
+				checkUrls = append(checkUrls, newUrls[i])
 			}
+		}
 
-			_, ok, err := self.gk.Find(newUrls[i])
+		// сначала дешево отсеем точно новые урлы блум-фильтром
+		toFind := make([]int, 0, len(toCheck))
+		findUrls := make([]string, 0, len(toCheck))
+		if len(checkUrls) != 0 {
+			maybe, err := self.gk.MightContain(checkUrls)
 			if err != nil {
 				return err
 			}
 
-			if ok {
-				newUrls[i] = ""
+			for j, i := range toCheck {
+				if maybe[j] {
+					toFind = append(toFind, i)
+					findUrls = append(findUrls, newUrls[i])
+				}
+			}
+		}
+
+		if len(findUrls) != 0 {
+			found, err := self.gk.FindAll(findUrls)
+			if err != nil {
+				return err
+			}
+
+			for j, i := range toFind {
+				if found[j].Error != "" {
+					return errors.New(found[j].Error)
+				}
+
+				if found[j].Val != nil {
+					newUrls[i] = ""
+				}
 			}
 		}
 
@@ -1,9 +1,14 @@
 package gatekeeper
 
 import (
+	"io"
+	"net/http"
 	"net/rpc"
 	"psearch/util"
 	"psearch/util/errors"
+	"strconv"
+	"sync"
+	"time"
 )
 
 type Value struct {
@@ -12,6 +17,15 @@ type Value struct {
 	Len    uint64 `json:"len"`
 }
 
+func (self Value) After(other Value) bool {
+	return self.FNum > other.FNum || (self.FNum == other.FNum && self.Offset > other.Offset)
+}
+
+// name is fnum:offset for errors.
+func (self Value) name() string {
+	return strconv.FormatUint(uint64(self.FNum), 10) + ":" + strconv.FormatUint(self.Offset, 10)
+}
+
 type FindArgs struct {
 	Url string `json:"url"`
 }
@@ -20,20 +34,228 @@ type FindResult struct {
 	Val *Value `json:"val,omitempty"`
 }
 
+// Meta is what the downloader knows about a fetched document.
+type Meta struct {
+	Status      int         `json:"status,omitempty"`
+	ContentType string      `json:"content_type,omitempty"`
+	Headers     http.Header `json:"headers,omitempty"`
+	FetchTime   time.Time   `json:"fetch_time"`
+	Hash        string      `json:"hash,omitempty"`
+}
+
+// ReadResult.Expires is the unix time the version expires at, 0 if it
+// never does, only ReadVersion sets it.
 type ReadResult struct {
 	FindResult
-	Body *string `json:"body,omitempty"`
+	Body    *string `json:"body,omitempty"`
+	Meta    *Meta   `json:"meta,omitempty"`
+	Expires int64   `json:"expires,omitempty"`
+}
+
+type ReadMetaResult struct {
+	FindResult
+	Meta *Meta `json:"meta,omitempty"`
+}
+
+// ReadRangeArgs asks for Len bytes of the body at Offset. Val pins the
+// record read by the previous window, N is used if it is nil.
+type ReadRangeArgs struct {
+	FindArgs
+	N      int    `json:"n,omitempty"`
+	Val    *Value `json:"val,omitempty"`
+	Offset int64  `json:"offset"`
+	Len    int64  `json:"len"`
+}
+
+// ReadRangeResult.Data is base64 in json, so binary bodies pass intact. Size
+// is the length of the whole body, Expires is as in ReadResult.
+type ReadRangeResult struct {
+	FindResult
+	Data    []byte `json:"data"`
+	Size    int64  `json:"size"`
+	Meta    *Meta  `json:"meta,omitempty"`
+	Expires int64  `json:"expires,omitempty"`
 }
 
+// WriteArgs.Data is the body as base64 in json, it is written instead of
+// Body if set, so binary bodies pass intact. TTL is in seconds, 0 for the
+// default of the url and -1 to keep the document forever. Expires is the
+// unix time to expire at instead. If IfCurrent is set, the document is
+// written only if the current version is still IfCurrent, a zero Value for
+// none, otherwise Val is nil.
 type WriteArgs struct {
 	FindArgs
-	Body string `json:"body"`
+	Body    string `json:"body"`
+	Data    []byte `json:"data,omitempty"`
+	Meta    *Meta  `json:"meta,omitempty"`
+	TTL     int    `json:"ttl,omitempty"`
+	Expires int64  `json:"expires,omitempty"`
+	// sync, group or seal, see DurabilitySync
+	Durability string `json:"durability,omitempty"`
+	IfCurrent  *Value `json:"if_current,omitempty"`
+}
+
+func (self *WriteArgs) body() []byte {
+	if self.Data != nil {
+		return self.Data
+	}
+	return []byte(self.Body)
 }
 
 type WriteResult struct {
 	Val Value `json:"val"`
 }
 
+type FindAllArgs struct {
+	Urls []string `json:"urls"`
+}
+
+type WriteAllArgs struct {
+	Docs []WriteArgs `json:"docs"`
+}
+
+// FindAllResult is the result of Find or Write for one url of a batch, the
+// error is empty on success.
+type FindAllResult struct {
+	FindResult
+	Error string `json:"error,omitempty"`
+}
+
+type ReadAllResult struct {
+	ReadResult
+	Error string `json:"error,omitempty"`
+}
+
+// VersionArgs.N is the version to read, the current one is 0.
+type VersionArgs struct {
+	FindArgs
+	N int `json:"n"`
+}
+
+type VersionsResult struct {
+	Vals []Value `json:"vals"`
+}
+
+// FindByHashArgs.Hash is the BodyHash of a body.
+type FindByHashArgs struct {
+	Hash string `json:"hash"`
+}
+
+type DeleteResult struct {
+	Deleted bool `json:"deleted"`
+}
+
+type ScanArgs struct {
+	Prefix     string `json:"prefix"`
+	StartAfter string `json:"start_after,omitempty"`
+	Limit      int    `json:"limit"`
+}
+
+type ScanItem struct {
+	Key string `json:"key"`
+	Url string `json:"url"`
+	Val Value  `json:"val"`
+}
+
+// ScanResult.Next is the StartAfter of the next page, empty on the last page.
+type ScanResult struct {
+	Items []ScanItem `json:"items"`
+	Next  string     `json:"next,omitempty"`
+}
+
+// ChangesArgs.Since is the Next of the previous call, 0 to start from the
+// beginning. Wait is how long to wait for a write in milliseconds if there is
+// nothing new. Node is used by the front to pick the gatekeeper.
+type ChangesArgs struct {
+	Node  int    `json:"node,omitempty"`
+	Since uint64 `json:"since"`
+	Limit int    `json:"limit"`
+	Wait  int    `json:"wait,omitempty"`
+}
+
+// ChangeItem is a write or a delete of the url. Moved ones are copies made
+// by the merger, they come again if the chunk was merged before the cursor
+// got past it.
+type ChangeItem struct {
+	Seq     uint64 `json:"seq"`
+	Key     string `json:"key"`
+	Url     string `json:"url"`
+	Val     Value  `json:"val"`
+	Deleted bool   `json:"deleted,omitempty"`
+	Moved   bool   `json:"moved,omitempty"`
+}
+
+type ChangesResult struct {
+	Items []ChangeItem `json:"items"`
+	Next  uint64       `json:"next"`
+}
+
+// Histogram counts calls by latency: Counts[i] took up to Bounds[i]
+// milliseconds, the last count is for the slower ones.
+type Histogram struct {
+	Bounds []float64 `json:"bounds_ms"`
+	Counts []uint64  `json:"counts"`
+	SumMs  float64   `json:"sum_ms"`
+}
+
+// Stats.SinceSync is in seconds, SyncedOffset is how much of the current
+// chunk survives a crash of the machine. Reads and Writes count documents, a WriteAll
+// is one call in WriteLatency though.
+type Stats struct {
+	Keys             uint        `json:"keys"`
+	TrieNodes        uint        `json:"trie_nodes"`
+	PerChunk         []ChunkInfo `json:"per_chunk"`
+	CurrentChunk     uint        `json:"current_chunk"`
+	CurrentOffset    uint64      `json:"current_offset"`
+	SinceSync        float64     `json:"since_sync"`
+	SyncedOffset     uint64      `json:"synced_offset"`
+	Reads            uint64      `json:"reads"`
+	ReadErrors       uint64      `json:"read_errors"`
+	ReadLatency      Histogram   `json:"read_latency"`
+	Writes           uint64      `json:"writes"`
+	WriteErrors      uint64      `json:"write_errors"`
+	WriteLatency     Histogram   `json:"write_latency"`
+	Chunks           int         `json:"chunks"`
+	Size             uint64      `json:"size"`
+	Live             uint64      `json:"live"`
+	RawBodies        uint64      `json:"raw_bodies"`
+	StoredBodies     uint64      `json:"stored_bodies"`
+	CompressionRatio float64     `json:"compression_ratio"`
+	BloomBits        uint64      `json:"bloom_bits"`
+	BloomHashes      uint        `json:"bloom_hashes"`
+	BloomKeys        uint        `json:"bloom_keys"`
+	BloomFPRate      float64     `json:"bloom_fp_rate"`
+	Blobs            int         `json:"blobs"`
+	Refs             int         `json:"refs"`
+}
+
+type ChunkInfo struct {
+	FNum      uint   `json:"fnum"`
+	Size      uint64 `json:"size"`
+	Live      uint64 `json:"live"`
+	Dead      uint64 `json:"dead"`
+	Corrupted uint   `json:"corrupted,omitempty"`
+}
+
+// Health is what balancers and the front probe. Role is master or replica,
+// Uptime is in seconds.
+type Health struct {
+	Ok     bool    `json:"ok"`
+	Role   string  `json:"role"`
+	Master string  `json:"master,omitempty"`
+	Keys   uint    `json:"keys"`
+	Uptime float64 `json:"uptime"`
+}
+
+type ChunkArgs struct {
+	FNum uint `json:"fnum"`
+}
+
+type ChunkData struct {
+	FNum uint   `json:"fnum"`
+	Data []byte `json:"data"`
+}
+
 type GatekeeperClient struct {
 	*rpc.Client
 }
@@ -47,6 +269,73 @@ func NewGatekeeperClient(addr string) (GatekeeperClient, error) {
 	return GatekeeperClient{c}, nil
 }
 
+// GatekeeperClients keeps a client for every gatekeeper called, shared by
+// concurrent calls. A client is redialed after a transport error; an error
+// returned by the gatekeeper keeps it.
+type GatekeeperClients struct {
+	mutex   sync.Mutex
+	clients map[string]*GatekeeperClient
+}
+
+func (self *GatekeeperClients) client(addr string) (*GatekeeperClient, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if c, ok := self.clients[addr]; ok {
+		return c, nil
+	}
+
+	c, err := NewGatekeeperClient(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if self.clients == nil {
+		self.clients = map[string]*GatekeeperClient{}
+	}
+	self.clients[addr] = &c
+	return &c, nil
+}
+
+// drop closes c, unless another call has redialed addr already.
+func (self *GatekeeperClients) drop(addr string, c *GatekeeperClient) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.clients[addr] == c {
+		c.Close()
+		delete(self.clients, addr)
+	}
+}
+
+// Call calls the GatekeeperServer method of the gatekeeper at addr.
+func (self *GatekeeperClients) Call(addr, method string, args, result interface{}) error {
+	c, err := self.client(addr)
+	if err != nil {
+		return err
+	}
+
+	if err := c.Call("GatekeeperServer."+method, args, result); err != nil {
+		// any error but the one of the server might be a broken
+		// connection
+		if _, ok := err.(rpc.ServerError); !ok {
+			self.drop(addr, c)
+		}
+		return errors.NewErr(err)
+	}
+	return nil
+}
+
+func (self *GatekeeperClients) Close() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for addr, c := range self.clients {
+		c.Close()
+		delete(self.clients, addr)
+	}
+}
+
 func (self *GatekeeperClient) Find(url string) (Value, bool, error) {
 	var res FindResult
 	if err := self.Call("GatekeeperServer.Find", FindArgs{Url: url}, &res); err != nil {
@@ -71,11 +360,221 @@ func (self *GatekeeperClient) Read(url string) (Value, bool, string, error) {
 	return *res.Val, true, *res.Body, nil
 }
 
+func (self *GatekeeperClient) FindAll(urls []string) ([]FindAllResult, error) {
+	var res []FindAllResult
+	if err := self.Call("GatekeeperServer.FindAll", FindAllArgs{Urls: urls}, &res); err != nil {
+		return nil, errors.NewErr(err)
+	}
+
+	return res, nil
+}
+
+func (self *GatekeeperClient) ReadAll(urls []string) ([]ReadAllResult, error) {
+	var res []ReadAllResult
+	if err := self.Call("GatekeeperServer.ReadAll", FindAllArgs{Urls: urls}, &res); err != nil {
+		return nil, errors.NewErr(err)
+	}
+
+	return res, nil
+}
+
+func (self *GatekeeperClient) WriteAll(docs []WriteArgs) ([]FindAllResult, error) {
+	var res []FindAllResult
+	if err := self.Call("GatekeeperServer.WriteAll", WriteAllArgs{Docs: docs}, &res); err != nil {
+		return nil, errors.NewErr(err)
+	}
+
+	return res, nil
+}
+
+// MightContain returns false for the urls that are definitely not stored.
+func (self *GatekeeperClient) MightContain(urls []string) ([]bool, error) {
+	var res []bool
+	if err := self.Call("GatekeeperServer.MightContain", FindAllArgs{Urls: urls}, &res); err != nil {
+		return nil, errors.NewErr(err)
+	}
+
+	return res, nil
+}
+
+// ReadMeta is Read without the body, the metadata is nil for documents
+// written without it.
+func (self *GatekeeperClient) ReadMeta(url string) (Value, bool, *Meta, error) {
+	var res ReadMetaResult
+	if err := self.Call("GatekeeperServer.ReadMeta", FindArgs{Url: url}, &res); err != nil {
+		return Value{}, false, nil, errors.NewErr(err)
+	}
+
+	if res.Val == nil {
+		return Value{}, false, nil, nil
+	}
+	return *res.Val, true, res.Meta, nil
+}
+
+// FindByHash returns where the body with the BodyHash hash is stored.
+func (self *GatekeeperClient) FindByHash(hash string) (Value, bool, error) {
+	var res FindResult
+	if err := self.Call("GatekeeperServer.FindByHash", FindByHashArgs{Hash: hash}, &res); err != nil {
+		return Value{}, false, errors.NewErr(err)
+	}
+
+	if res.Val == nil {
+		return Value{}, false, nil
+	}
+	return *res.Val, true, nil
+}
+
+func (self *GatekeeperClient) ReadVersion(url string, n int) (Value, bool, string, error) {
+	var res ReadResult
+	if err := self.Call("GatekeeperServer.ReadVersion", VersionArgs{FindArgs{Url: url}, n}, &res); err != nil {
+		return Value{}, false, "", errors.NewErr(err)
+	}
+
+	if res.Val == nil {
+		return Value{}, false, "", nil
+	}
+	return *res.Val, true, *res.Body, nil
+}
+
+// ReadRange reads a window of the body of url, see ReadRangeArgs.
+func (self *GatekeeperClient) ReadRange(args ReadRangeArgs) (ReadRangeResult, error) {
+	var res ReadRangeResult
+	if err := self.Call("GatekeeperServer.ReadRange", args, &res); err != nil {
+		return ReadRangeResult{}, errors.NewErr(err)
+	}
+
+	return res, nil
+}
+
+// ReadTo copies the body of url to w window by window, so it is never
+// whole in memory.
+func (self *GatekeeperClient) ReadTo(url string, w io.Writer) (Value, bool, *Meta, error) {
+	args := ReadRangeArgs{
+		FindArgs: FindArgs{Url: url},
+	}
+	for {
+		res, err := self.ReadRange(args)
+		if err != nil {
+			return Value{}, false, nil, err
+		}
+		if res.Val == nil {
+			return Value{}, false, nil, nil
+		}
+
+		if _, err := w.Write(res.Data); err != nil {
+			return Value{}, false, nil, errors.NewErr(err)
+		}
+
+		args.Val = res.Val
+		args.Offset += int64(len(res.Data))
+		if args.Offset >= res.Size {
+			return *res.Val, true, res.Meta, nil
+		}
+	}
+}
+
+// Changes returns the writes after args.Since, see ChangesArgs.
+func (self *GatekeeperClient) Changes(args ChangesArgs) (ChangesResult, error) {
+	var res ChangesResult
+	if err := self.Call("GatekeeperServer.Changes", args, &res); err != nil {
+		return ChangesResult{}, errors.NewErr(err)
+	}
+
+	return res, nil
+}
+
+// ListVersions returns the kept versions of url, newest first.
+func (self *GatekeeperClient) ListVersions(url string) ([]Value, error) {
+	var res VersionsResult
+	if err := self.Call("GatekeeperServer.ListVersions", FindArgs{Url: url}, &res); err != nil {
+		return nil, errors.NewErr(err)
+	}
+
+	return res.Vals, nil
+}
+
 func (self *GatekeeperClient) Write(url string, body string) (Value, error) {
 	var res WriteResult
-	if err := self.Call("GatekeeperServer.Write", WriteArgs{FindArgs{Url: url}, body}, &res); err != nil {
+	if err := self.Call("GatekeeperServer.Write", WriteArgs{FindArgs{Url: url}, body, nil, nil, 0, 0, "", nil}, &res); err != nil {
 		return Value{}, errors.NewErr(err)
 	}
 
 	return res.Val, nil
 }
+
+func (self *GatekeeperClient) WriteWithMeta(url string, body string, meta Meta) (Value, error) {
+	var res WriteResult
+	if err := self.Call("GatekeeperServer.Write", WriteArgs{FindArgs{Url: url}, body, nil, &meta, 0, 0, "", nil}, &res); err != nil {
+		return Value{}, errors.NewErr(err)
+	}
+
+	return res.Val, nil
+}
+
+// WriteTTL writes a document that is gone after ttl, rounded to seconds.
+func (self *GatekeeperClient) WriteTTL(url string, body string, ttl time.Duration) (Value, error) {
+	var res WriteResult
+	if err := self.Call("GatekeeperServer.Write", WriteArgs{FindArgs{Url: url}, body, nil, nil, int(ttl / time.Second), 0, "", nil}, &res); err != nil {
+		return Value{}, errors.NewErr(err)
+	}
+
+	return res.Val, nil
+}
+
+func (self *GatekeeperClient) Delete(url string) (bool, error) {
+	var res DeleteResult
+	if err := self.Call("GatekeeperServer.Delete", FindArgs{Url: url}, &res); err != nil {
+		return false, errors.NewErr(err)
+	}
+
+	return res.Deleted, nil
+}
+
+func (self *GatekeeperClient) Scan(prefix, startAfter string, limit int) ([]ScanItem, string, error) {
+	var res ScanResult
+	if err := self.Call("GatekeeperServer.Scan", ScanArgs{Prefix: prefix, StartAfter: startAfter, Limit: limit}, &res); err != nil {
+		return nil, "", errors.NewErr(err)
+	}
+
+	return res.Items, res.Next, nil
+}
+
+func (self *GatekeeperClient) Health() (Health, error) {
+	var res Health
+	if err := self.Call("GatekeeperServer.Health", struct{}{}, &res); err != nil {
+		return Health{}, errors.NewErr(err)
+	}
+
+	return res, nil
+}
+
+func (self *GatekeeperClient) Stats() (Stats, error) {
+	var res Stats
+	if err := self.Call("GatekeeperServer.Stats", struct{}{}, &res); err != nil {
+		return Stats{}, errors.NewErr(err)
+	}
+
+	return res, nil
+}
+
+func (self *GatekeeperClient) Chunks() ([]ChunkInfo, error) {
+	var res []ChunkInfo
+	if err := self.Call("GatekeeperServer.Chunks", struct{}{}, &res); err != nil {
+		return nil, errors.NewErr(err)
+	}
+
+	return res, nil
+}
+
+func (self *GatekeeperClient) ReadChunk(num uint) ([]byte, error) {
+	var res ChunkData
+	if err := self.Call("GatekeeperServer.ReadChunk", ChunkArgs{FNum: num}, &res); err != nil {
+		return nil, errors.NewErr(err)
+	}
+
+	return res.Data, nil
+}
+
+func (self *GatekeeperClient) PushChunk(num uint, data []byte) error {
+	return errors.NewErr(self.Call("GatekeeperServer.PushChunk", ChunkData{FNum: num, Data: data}, &struct{}{}))
+}
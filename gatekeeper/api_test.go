@@ -0,0 +1,42 @@
+package gatekeeper
+
+import (
+	"testing"
+)
+
+// TestClientsKeepClient checks that an error returned by the gatekeeper
+// keeps the connection, and a broken connection is redialed.
+func TestClientsKeepClient(t *testing.T) {
+	gk := openTest(t, t.TempDir(), 1<<20)
+	defer gk.Close()
+	addr, kill := serveTest(t, gk)
+
+	var clients GatekeeperClients
+	defer clients.Close()
+
+	var res FindResult
+	if err := clients.Call(addr, "Find", FindArgs{Url: "http://a.ru/"}, &res); err != nil {
+		t.Fatal(err)
+	}
+	c := clients.clients[addr]
+
+	var rr ReadRangeResult
+	args := ReadRangeArgs{FindArgs: FindArgs{Url: "http://a.ru/"}, Val: &Value{Len: 1}}
+	if err := clients.Call(addr, "ReadRange", args, &rr); err == nil {
+		t.Fatal("ReadRange of a made up record")
+	}
+	if clients.clients[addr] != c {
+		t.Fatal("Dropped the client on an error of the server")
+	}
+
+	kill()
+	if err := clients.Call(addr, "Find", FindArgs{Url: "http://a.ru/"}, &res); err == nil {
+		t.Fatal("Call over a broken connection")
+	}
+	if _, ok := clients.clients[addr]; ok {
+		t.Fatal("Kept a broken client")
+	}
+	if err := clients.Call(addr, "Find", FindArgs{Url: "http://a.ru/"}, &res); err != nil {
+		t.Fatal("Not redialed", err)
+	}
+}
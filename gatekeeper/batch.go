@@ -0,0 +1,166 @@
+package gatekeeper
+
+import (
+	"psearch/util/errors"
+	"psearch/util/log"
+	"time"
+)
+
+// WriteAll writes the documents like Write does one by one, but syncs the
+// chunk only once at the end. A document skipped for IfCurrent gets a zero
+// Value.
+func (self *Gatekeeper) WriteAll(docs []WriteArgs) ([]Value, []error) {
+	log.Printf("Gatekeeper.WriteAll(%v)\n", len(docs))
+	res := make([]Value, len(docs))
+	errs := make([]error, len(docs))
+	recs := make([]record, len(docs))
+	keys := make([]string, len(docs))
+	for i, d := range docs {
+		if keys[i], errs[i] = UrlTransform(d.Url); errs[i] != nil {
+			continue
+		}
+		recs[i], errs[i] = newRecord(d.Url, d.Meta, d.body())
+	}
+
+	// the batch is committed once, as the strictest document asks
+	mode := ""
+	for i, d := range docs {
+		if errs[i] != nil {
+			continue
+		}
+		var m string
+		if m, errs[i] = self.durabilityOf(d.Durability); errs[i] == nil {
+			mode = stricter(mode, m)
+		}
+	}
+
+	start := time.Now()
+	self.mutex.Lock()
+	written, skipped := 0, 0
+	for i := range docs {
+		if errs[i] != nil {
+			continue
+		}
+		if docs[i].IfCurrent != nil && !self.isCurrent(keys[i], *docs[i].IfCurrent) {
+			skipped += 1
+			continue
+		}
+
+		self.expiry(&recs[i], time.Duration(docs[i].TTL)*time.Second, docs[i].Expires)
+		self.dedup(&recs[i])
+		if res[i], errs[i] = self.appendRecord(recs[i]); errs[i] != nil {
+			continue
+		}
+		self.apply([]byte(keys[i]), recs[i], res[i])
+		written += 1
+	}
+	self.mutex.Unlock()
+
+	var err error
+	if written != 0 {
+		if err = self.commit(mode); err != nil {
+			for i := range docs {
+				if errs[i] == nil {
+					errs[i] = err
+				}
+			}
+			written = 0
+		}
+	}
+
+	if err == nil && written+skipped != len(docs) {
+		err = errors.New("Some documents are not written!")
+	}
+	self.writes.add(start, written, err)
+
+	log.Printf("Gatekeeper.WriteAll(%v) OK (%v written)\n", len(docs), written)
+	return res, errs
+}
+
+// MightContain tells for every key if it might be stored, false means it is
+// definitely not.
+func (self *Gatekeeper) MightContain(keys []string) []bool {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	res := make([]bool, len(keys))
+	for i, k := range keys {
+		res[i] = self.bloom.Test([]byte(k))
+	}
+	return res
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// FindAll is Find for every url, an error of one url doesn't fail the others.
+func (self *GatekeeperServer) FindAll(args *FindAllArgs, result *[]FindAllResult) error {
+	res := make([]FindAllResult, len(args.Urls))
+	for i, u := range args.Urls {
+		err := self.Find(&FindArgs{Url: u}, &res[i].FindResult)
+		res[i].Error = errorString(err)
+	}
+
+	*result = res
+	return nil
+}
+
+// ReadAll is Read for every url, an error of one url doesn't fail the others.
+func (self *GatekeeperServer) ReadAll(args *FindAllArgs, result *[]ReadAllResult) error {
+	res := make([]ReadAllResult, len(args.Urls))
+	for i, u := range args.Urls {
+		err := self.Read(&FindArgs{Url: u}, &res[i].ReadResult)
+		res[i].Error = errorString(err)
+	}
+
+	*result = res
+	return nil
+}
+
+// WriteAll is Write for every document with a single sync.
+func (self *GatekeeperServer) WriteAll(args *WriteAllArgs, result *[]FindAllResult) error {
+	vals, errs := self.Gatekeeper.WriteAll(args.Docs)
+	res := make([]FindAllResult, len(args.Docs))
+	for i := range args.Docs {
+		if errs[i] != nil {
+			log.Errorln(errs[i], args.Docs[i].Url)
+			res[i].Error = errs[i].Error()
+			continue
+		}
+
+		// IfCurrent didn't match
+		if vals[i].Len == 0 {
+			continue
+		}
+		r := vals[i]
+		res[i].Val = &r
+	}
+
+	*result = res
+	return nil
+}
+
+// MightContain filters urls through the bloom filter only, urls that can't
+// be stored are never there.
+func (self *GatekeeperServer) MightContain(args *FindAllArgs, result *[]bool) error {
+	keys := make([]string, 0, len(args.Urls))
+	idx := make([]int, 0, len(args.Urls))
+	for i, u := range args.Urls {
+		if k, err := UrlTransform(u); err == nil {
+			keys = append(keys, k)
+			idx = append(idx, i)
+		}
+	}
+
+	res := make([]bool, len(args.Urls))
+	for j, ok := range self.Gatekeeper.MightContain(keys) {
+		res[idx[j]] = ok
+	}
+
+	*result = res
+	return nil
+}
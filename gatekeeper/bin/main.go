@@ -2,8 +2,12 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"net/http"
 	"net/rpc"
 	"psearch/gatekeeper"
+	"psearch/gatekeeper/front"
+	"psearch/util"
 	"psearch/util/errors"
 	"psearch/util/graceful"
 	gjsonrpc "psearch/util/graceful/jsonrpc"
@@ -12,12 +16,40 @@ import (
 	"time"
 )
 
+type Urls []string
+
+func (self *Urls) String() string {
+	return fmt.Sprintf("%v", *self)
+}
+
+func (self *Urls) Set(value string) error {
+	*self = append(*self, value)
+	return nil
+}
+
 func main() {
 	var help = flag.Bool("help", false, "print help")
 	var port = flag.Int("port", -1, "port to listen")
+	var httpPort = flag.Int("http-port", -1, "port to serve raw bodies over http at /raw?url= and /health, -1 to disable")
 	var dir = flag.String("dir", "", "data directory")
 	var maxFileSize = flag.Int("max-size", 10*1024*1024, "maximum file size")
 	var maxTime = flag.Int("max-time", 1*60, "maximum time between sync calls (in seconds)")
+	var durability = flag.String("durability", gatekeeper.DurabilityGroup, "when writes are synced: sync (every write), group (writes within -group-delay together) or seal (with the chunk and every -max-time)")
+	var groupDelay = flag.Int("group-delay", 1, "time group commit gathers writes (in ms)")
+	var mergeInterval = flag.Int("merge-interval", 10*60, "time between chunk merges (in seconds), 0 to disable")
+	var mergeRatio = flag.Float64("merge-ratio", 0.5, "minimum fraction of overwritten bytes for a chunk to be merged")
+	var versions = flag.Int("versions", 0, "number of older versions to keep for every url")
+	var ttlConfig = flag.String("ttl-config", "", "json file with the default TTLs by host and path prefix")
+	var bloomKeys = flag.Uint("bloom-keys", 10*1000*1000, "number of urls the bloom filter is sized for")
+	var bloomFP = flag.Float64("bloom-fp", 0.01, "false positive rate of the bloom filter")
+	var snapshotInterval = flag.Int("snapshot-interval", 10*60, "time between index snapshots (in seconds), 0 to disable")
+	var master = flag.String("master", "", "master address, run as a read-only replica if set")
+	var replicas Urls
+	flag.Var(&replicas, "replica", "replica address")
+	var syncInterval = flag.Int("sync-interval", 10, "time between replica catch-up calls to the master (in seconds)")
+	var frontAddr = flag.String("front", "", "front address, the front assigns master and replicas if set")
+	var addr = flag.String("addr", "", "address of this gatekeeper for the front and other gatekeepers (default localhost:port)")
+	var heartbeat = flag.Int("heartbeat", 1000, "time between heartbeats to the front (in ms)")
 	var gracefulRestart = graceful.SetFlag()
 	flag.Parse()
 
@@ -26,13 +58,86 @@ func main() {
 		return
 	}
 
-	gk, err := gatekeeper.NewGatekeeper(*dir, uint64(*maxFileSize), time.Duration(*maxTime)*time.Second)
+	gk, err := gatekeeper.NewGatekeeper(*dir, uint64(*maxFileSize), time.Duration(*maxTime)*time.Second, *versions, *bloomKeys, *bloomFP)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if err := gk.SetMaster(*master); err != nil {
+		log.Fatal(err)
+	}
+	gk.SetReplicas(replicas)
+
+	if err := gk.SetDurability(*durability, time.Duration(*groupDelay)*time.Millisecond); err != nil {
+		log.Fatal(err)
+	}
+
+	if *ttlConfig != "" {
+		rules, err := gatekeeper.LoadTTLRules(*ttlConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		gk.SetTTLRules(rules)
+	}
+
+	if *master != "" || *frontAddr != "" {
+		go func() {
+			for {
+				if err := gk.RunReplica(time.Duration(*syncInterval) * time.Second); err != nil {
+					log.Errorln(err)
+					time.Sleep(time.Duration(*syncInterval) * time.Second)
+				}
+			}
+		}()
+	}
+
+	if *mergeInterval > 0 {
+		go func() {
+			for {
+				if err := gk.RunMerger(time.Duration(*mergeInterval)*time.Second, *mergeRatio); err != nil {
+					log.Errorln(err)
+				}
+			}
+		}()
+	}
+
+	if *snapshotInterval > 0 {
+		go func() {
+			for {
+				if err := gk.RunSnapshots(time.Duration(*snapshotInterval) * time.Second); err != nil {
+					log.Errorln(err)
+				}
+			}
+		}()
+	}
+
+	if *frontAddr != "" {
+		if *addr == "" {
+			*addr = "localhost:" + strconv.Itoa(*port)
+		}
+
+		go func() {
+			for {
+				if err := front.RunHeartbeats(gk, *frontAddr, *addr, time.Duration(*heartbeat)*time.Millisecond); err != nil {
+					log.Errorln(err)
+					time.Sleep(time.Duration(*heartbeat) * time.Millisecond)
+				}
+			}
+		}()
+	}
+
+	gkServer := &gatekeeper.GatekeeperServer{gk}
+	if *httpPort != -1 {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/raw", util.CreateErrorHandler(gkServer.ServeRaw))
+		mux.HandleFunc("/health", util.CreateErrorHandler(gkServer.ServeHealth))
+		go func() {
+			log.Fatal(errors.NewErr(http.ListenAndServe(":"+strconv.Itoa(*httpPort), mux)))
+		}()
+	}
+
 	srv := rpc.NewServer()
-	srv.Register(&gatekeeper.GatekeeperServer{gk})
+	srv.Register(gkServer)
 
 	server := gjsonrpc.NewServer(srv)
 	graceful.SetSighup(server)
@@ -0,0 +1,199 @@
+package gatekeeper
+
+import (
+	"io"
+	"os"
+	"psearch/util/log"
+	"time"
+)
+
+// seqBits is the room for the offset in a sequence number, chunks are far
+// smaller than a terabyte.
+const seqBits = 40
+
+// MaxChangesLimit and MaxChangesWait bound a single Changes call.
+const (
+	MaxChangesLimit = 1000
+	MaxChangesWait  = time.Minute
+)
+
+// Seq is the position of the record in the chunks of the gatekeeper, it
+// grows with every write.
+func (self Value) Seq() uint64 {
+	return uint64(self.FNum)<<seqBits | self.Offset
+}
+
+// SeqValue is the position of seq, without the length.
+func SeqValue(seq uint64) Value {
+	return Value{
+		FNum:   uint(seq >> seqBits),
+		Offset: seq & (1<<seqBits - 1),
+	}
+}
+
+type changeChunk struct {
+	num   uint
+	start uint64
+	end   uint64
+}
+
+func chunkStart(c *chunkT) uint64 {
+	if c.version == chunkV2 {
+		return uint64(len(chunkMagic))
+	}
+	return 0
+}
+
+// notify wakes up the callers of Changes waiting for a write.
+func (self *Gatekeeper) notify() {
+	if self.changed != nil {
+		close(self.changed)
+		self.changed = nil
+	}
+}
+
+// pending returns the written parts of the chunks after the cursor, or a
+// channel the next write closes if there are none.
+func (self *Gatekeeper) pending(cursor Value) ([]changeChunk, chan struct{}) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	res := []changeChunk{}
+	for _, num := range self.chunkNums() {
+		if num < cursor.FNum {
+			continue
+		}
+
+		c := self.chunks[num]
+		start := chunkStart(c)
+		if num == cursor.FNum && cursor.Offset > start {
+			start = cursor.Offset
+		}
+		if c.size > start {
+			res = append(res, changeChunk{num, start, c.size})
+		}
+	}
+
+	if len(res) != 0 {
+		return res, nil
+	}
+	if self.changed == nil {
+		self.changed = make(chan struct{})
+	}
+	return nil, self.changed
+}
+
+// readChanges appends the records of c to res, up to limit of them, and
+// returns the sequence number after the last one read.
+func (self *Gatekeeper) readChanges(c changeChunk, limit int, res *[]ChangeItem) (uint64, error) {
+	next := Value{FNum: c.num, Offset: c.start}
+	name := self.chunkName(c.num)
+	// the merger removed it, the live records are copied to a newer chunk
+	if _, err := os.Stat(name); os.IsNotExist(err) {
+		return next.Seq(), nil
+	}
+
+	file, err := openChunk(name)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	if c.start > file.offset {
+		if err := file.Seek(c.start); err != nil {
+			return 0, err
+		}
+	}
+
+	for len(*res) < limit && file.offset < c.end {
+		offset, n, rec, err := file.Next()
+		if err == io.EOF || err == errTornRecord {
+			break
+		}
+		if err == errCorruptRecord {
+			next.Offset = offset + n
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		next.Offset = offset + n
+		if rec.flags&flagBlob != 0 {
+			continue
+		}
+
+		key, err := UrlTransform(string(rec.url))
+		if err != nil {
+			return 0, err
+		}
+
+		val := Value{FNum: c.num, Offset: offset, Len: n}
+		*res = append(*res, ChangeItem{
+			Seq:     val.Seq(),
+			Key:     key,
+			Url:     string(rec.url),
+			Val:     val,
+			Deleted: rec.flags&flagTombstone != 0,
+			Moved:   rec.flags&flagMoved != 0,
+		})
+	}
+	return next.Seq(), nil
+}
+
+// Changes returns up to limit records written at or after the sequence
+// number since, and the since of the next call. If there are none yet it
+// waits for a write up to wait. The records are read from the chunks, so a
+// cursor stays valid across restarts.
+func (self *Gatekeeper) Changes(since uint64, limit int, wait time.Duration) ([]ChangeItem, uint64, error) {
+	log.Printf("Gatekeeper.Changes(%v, %v, %v)\n", since, limit, wait)
+	if limit <= 0 || limit > MaxChangesLimit {
+		limit = MaxChangesLimit
+	}
+	if wait > MaxChangesWait {
+		wait = MaxChangesWait
+	}
+
+	cursor := SeqValue(since)
+	chunks, changed := self.pending(cursor)
+	if changed != nil && wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-changed:
+		case <-timer.C:
+		}
+		timer.Stop()
+		chunks, _ = self.pending(cursor)
+	}
+
+	res := []ChangeItem{}
+	next := since
+	for _, c := range chunks {
+		if len(res) >= limit {
+			break
+		}
+
+		n, err := self.readChanges(c, limit-len(res), &res)
+		if err != nil {
+			return nil, 0, err
+		}
+		next = n
+	}
+
+	log.Printf("Gatekeeper.Changes(%v, %v, %v) OK (%v changes, next %v)\n", since, limit, wait, len(res), next)
+	return res, next, nil
+}
+
+func (self *GatekeeperServer) Changes(args *ChangesArgs, result *ChangesResult) error {
+	items, next, err := self.Gatekeeper.Changes(args.Since, args.Limit, time.Duration(args.Wait)*time.Millisecond)
+	if err != nil {
+		log.Errorln(err, args)
+		return err
+	}
+
+	*result = ChangesResult{
+		Items: items,
+		Next:  next,
+	}
+	return nil
+}
@@ -0,0 +1,212 @@
+package gatekeeper
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"psearch/util/errors"
+	"psearch/util/log"
+)
+
+// blobT is where the body with some hash is stored. Reference records of
+// other urls read the body from there, so the record stays live while refs
+// is not zero, even if its own url doesn't need it anymore.
+type blobT struct {
+	// Len is 0 until the record is seen, references may come first on replay
+	val  Value
+	refs int
+}
+
+// BodyHash is the content hash used for deduplication, hex of the sha1.
+func BodyHash(body []byte) string {
+	return hex.EncodeToString(bodyHash(body))
+}
+
+func bodyHash(body []byte) []byte {
+	h := sha1.Sum(body)
+	return h[:]
+}
+
+// hold adds a holder of the record at val, the record is live while it has any.
+func (self *Gatekeeper) hold(val Value) {
+	self.holds[val] += 1
+	if self.holds[val] == 1 {
+		self.live(val)
+	}
+}
+
+func (self *Gatekeeper) release(val Value) {
+	n, ok := self.holds[val]
+	if !ok {
+		return
+	}
+
+	if n > 1 {
+		self.holds[val] = n - 1
+		return
+	}
+
+	delete(self.holds, val)
+	self.unlive(val)
+}
+
+// moveHolds passes all the holders of the record at old to its copy at val.
+func (self *Gatekeeper) moveHolds(old, val Value) {
+	n := self.holds[old]
+	delete(self.holds, old)
+	self.unlive(old)
+
+	self.holds[val] = n
+	self.live(val)
+}
+
+func (self *Gatekeeper) holdVersion(v versionT) {
+	self.hold(v.val)
+	if v.ref != "" {
+		self.refBlob(v.ref)
+	}
+}
+
+func (self *Gatekeeper) releaseVersion(v versionT) {
+	self.release(v.val)
+	if v.ref != "" {
+		self.unrefBlob(v.ref)
+	}
+}
+
+// registerBlob records that the body with hash is stored at val. The newest
+// copy wins like for versions.
+func (self *Gatekeeper) registerBlob(hash string, val Value) {
+	b, ok := self.blobs[hash]
+	if !ok {
+		b = &blobT{}
+		self.blobs[hash] = b
+	}
+
+	if b.val.Len != 0 && !val.After(b.val) {
+		return
+	}
+
+	if b.refs > 0 {
+		self.hold(val)
+		if b.val.Len != 0 {
+			self.release(b.val)
+		}
+	}
+	b.val = val
+}
+
+func (self *Gatekeeper) refBlob(hash string) {
+	b, ok := self.blobs[hash]
+	if !ok {
+		b = &blobT{}
+		self.blobs[hash] = b
+	}
+
+	b.refs += 1
+	if b.refs == 1 && b.val.Len != 0 {
+		self.hold(b.val)
+	}
+}
+
+func (self *Gatekeeper) unrefBlob(hash string) {
+	b, ok := self.blobs[hash]
+	if !ok {
+		return
+	}
+
+	b.refs -= 1
+	if b.refs == 0 && b.val.Len != 0 {
+		self.release(b.val)
+	}
+}
+
+// dedup turns rec into a reference if its body is already stored and live.
+func (self *Gatekeeper) dedup(rec *record) {
+	if rec.flags&flagHash == 0 {
+		return
+	}
+
+	b, ok := self.blobs[string(rec.hash)]
+	if !ok || b.val.Len == 0 || self.holds[b.val] == 0 {
+		return
+	}
+
+	rec.flags = rec.flags&^flagCompressed | flagRef
+	rec.body = nil
+}
+
+// pruneBlobs forgets the bodies nobody needs.
+func (self *Gatekeeper) pruneBlobs() {
+	for hash, b := range self.blobs {
+		if b.refs == 0 && self.holds[b.val] == 0 {
+			delete(self.blobs, hash)
+		} else if b.val.Len == 0 {
+			log.Errorf("Body %x is lost, %v references to it are broken\n", hash, b.refs)
+		}
+	}
+}
+
+// readRef reads the record holding the body for the reference with hash.
+func (self *Gatekeeper) readRef(hash []byte) (record, error) {
+	for {
+		self.mutex.RLock()
+		b, ok := self.blobs[string(hash)]
+		val := Value{}
+		if ok {
+			val = b.val
+		}
+		self.mutex.RUnlock()
+		if val.Len == 0 {
+			return record{}, errors.New("Body " + hex.EncodeToString(hash) + " is lost!")
+		}
+
+		rec, err := self.readRecord(val)
+		if err == nil {
+			return rec, nil
+		}
+
+		// the merger might have moved the body and removed the chunk
+		self.mutex.RLock()
+		moved := b.val != val
+		self.mutex.RUnlock()
+		if !moved {
+			return record{}, err
+		}
+	}
+}
+
+// FindByHash returns where the body with the hex hash is stored, if it is
+// stored and live.
+func (self *Gatekeeper) FindByHash(hash string) (Value, bool, error) {
+	log.Printf("Gatekeeper.FindByHash(%v)\n", hash)
+	h, err := hex.DecodeString(hash)
+	if err != nil {
+		return Value{}, false, errors.NewErr(err)
+	}
+
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	b, ok := self.blobs[string(h)]
+	if !ok || b.val.Len == 0 || self.holds[b.val] == 0 {
+		return Value{}, false, nil
+	}
+
+	log.Printf("Gatekeeper.FindByHash(%v) OK (%+v)\n", hash, b.val)
+	return b.val, true, nil
+}
+
+func (self *GatekeeperServer) FindByHash(args *FindByHashArgs, result *FindResult) error {
+	r, ok, err := self.Gatekeeper.FindByHash(args.Hash)
+	if err != nil {
+		log.Errorln(err, args)
+		return err
+	}
+
+	if ok {
+		*result = FindResult{
+			Val: &r,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package gatekeeper
+
+import (
+	"os"
+	"psearch/util/errors"
+	"psearch/util/log"
+	"sync"
+	"time"
+)
+
+// Durability modes, what a write waits for before it returns. The records
+// are in the page cache once written, so a crash of the process loses
+// nothing, these are about a crash of the machine:
+//
+//	sync  -- fsync of every write, nothing acknowledged is lost
+//	group -- one fsync for the writes that come within the group delay,
+//	         nothing acknowledged is lost, a write waits up to the delay
+//	         and an fsync
+//	seal  -- fsync when the chunk is sealed, and on a write coming more
+//	         than maxTime after the last fsync, so up to maxTime or a chunk
+//	         of acknowledged writes is lost
+const (
+	DurabilitySync  = "sync"
+	DurabilityGroup = "group"
+	DurabilitySeal  = "seal"
+)
+
+func checkDurability(mode string) error {
+	switch mode {
+	case DurabilitySync, DurabilityGroup, DurabilitySeal:
+		return nil
+	}
+	return errors.New("Unknown durability mode " + mode + "!")
+}
+
+// SetDurability sets the mode of the writes that don't ask for another one,
+// delay is how long group commit gathers writes.
+func (self *Gatekeeper) SetDurability(mode string, delay time.Duration) error {
+	if err := checkDurability(mode); err != nil {
+		return err
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.durability = mode
+	self.group.delay = delay
+	return nil
+}
+
+// durabilityOf returns the mode of a write that asks for mode, the default
+// one if it is empty.
+func (self *Gatekeeper) durabilityOf(mode string) (string, error) {
+	if mode == "" {
+		self.mutex.RLock()
+		defer self.mutex.RUnlock()
+		if self.durability == "" {
+			return DurabilityGroup, nil
+		}
+		return self.durability, nil
+	}
+	return mode, checkDurability(mode)
+}
+
+// stricter returns the mode of a and b that loses less.
+func stricter(a, b string) string {
+	rank := map[string]int{DurabilitySeal: 1, DurabilityGroup: 2, DurabilitySync: 3}
+	if rank[b] > rank[a] {
+		return b
+	}
+	return a
+}
+
+// syncFile makes everything written to the current chunk so far durable.
+// The fsync runs without the lock, so writers go on meanwhile.
+func (self *Gatekeeper) syncFile() error {
+	self.mutex.RLock()
+	f, offset := self.file.file, self.file.offset
+	self.mutex.RUnlock()
+	if f == nil {
+		return nil
+	}
+
+	err := f.Sync()
+	// sealing synced and closed the chunk meanwhile
+	if pe, ok := err.(*os.PathError); ok && pe.Err == os.ErrClosed {
+		return nil
+	}
+	if err != nil {
+		return errors.NewErr(err)
+	}
+
+	self.markSynced(f, offset)
+	return nil
+}
+
+// markSynced records an fsync of f done without the write lock, unless the
+// chunk was sealed meanwhile.
+func (self *Gatekeeper) markSynced(f *os.File, offset uint64) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.file.file == f && self.file.durable < offset {
+		self.file.durable = offset
+		self.file.synced = time.Now()
+	}
+}
+
+// groupT is the group commit: writers take tickets after their records are
+// written, and one fsync started after a ticket was taken covers it.
+type groupT struct {
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	delay     time.Duration
+	requested uint64
+	completed uint64
+	err       error
+	running   bool
+	closed    bool
+}
+
+func (self *Gatekeeper) groupSync() error {
+	g := &self.group
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	// the record is written before Close, which synced it
+	if g.closed {
+		return g.err
+	}
+	if g.cond == nil {
+		g.cond = sync.NewCond(&g.mutex)
+	}
+	if !g.running {
+		g.running = true
+		go self.runGroup()
+	}
+
+	g.requested += 1
+	ticket := g.requested
+	g.cond.Broadcast()
+	for g.completed < ticket {
+		g.cond.Wait()
+	}
+	return g.err
+}
+
+func (self *Gatekeeper) runGroup() {
+	g := &self.group
+	for {
+		g.mutex.Lock()
+		for g.requested == g.completed && !g.closed {
+			g.cond.Wait()
+		}
+		if g.closed {
+			g.mutex.Unlock()
+			return
+		}
+		delay := g.delay
+		g.mutex.Unlock()
+
+		// let more writers come
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+
+		g.mutex.Lock()
+		target := g.requested
+		g.mutex.Unlock()
+
+		err := self.syncFile()
+		if err != nil {
+			log.Errorln(err)
+		}
+
+		g.mutex.Lock()
+		// Close completed the tickets meanwhile
+		if g.completed < target {
+			g.completed = target
+			g.err = err
+		}
+		g.cond.Broadcast()
+		g.mutex.Unlock()
+	}
+}
+
+// closeGroup completes the tickets taken so far with err of the last fsync
+// done by Close.
+func (self *Gatekeeper) closeGroup(err error) {
+	g := &self.group
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	g.closed = true
+	g.completed = g.requested
+	g.err = err
+	if g.cond != nil {
+		g.cond.Broadcast()
+	}
+}
+
+// commit waits until the writes done so far are as durable as mode asks.
+func (self *Gatekeeper) commit(mode string) error {
+	switch mode {
+	case DurabilitySync:
+		return self.syncFile()
+	case DurabilityGroup:
+		return self.groupSync()
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package gatekeeper
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// crash copies dir as a crash of the machine leaves it: only the fsynced
+// part of the current chunk is on disk, and torn more bytes of it.
+func crash(t *testing.T, gk *Gatekeeper, dir string, torn uint64) string {
+	st := gk.Stats()
+	res := t.TempDir()
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if f.Name() == "lock" || f.Name() == "index" {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Name() == strconv.FormatUint(uint64(st.CurrentChunk), 10) {
+			end := st.SyncedOffset + torn
+			if end > uint64(len(data)) {
+				end = uint64(len(data))
+			}
+			data = data[:end]
+		}
+		if err := ioutil.WriteFile(filepath.Join(res, f.Name()), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return res
+}
+
+// crashTest writes from many writers in mode, crashes and returns how many
+// acknowledged writes are lost and how many chunks were sealed. Only the
+// writes past the fsynced offset of the current chunk may be lost, and they
+// all must be.
+func crashTest(t *testing.T, mode, override string, maxFileSize, torn uint64) (int, uint) {
+	dir := t.TempDir()
+	gk := openTest(t, dir, maxFileSize)
+	if err := gk.SetDurability(mode, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	const writers, writes = 8, 100
+	var mutex sync.Mutex
+	acked := map[string]Value{}
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				u := fmt.Sprintf("http://h%d.ru/%d", w, i)
+				key, _ := UrlTransform(u)
+				val, err := gk.WriteWith(u, key, nil, []byte(fmt.Sprintf("%0300d", i)), WriteOptions{Durability: override})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				mutex.Lock()
+				acked[u] = val
+				mutex.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	st := gk.Stats()
+	crashed := crash(t, gk, dir, torn)
+	if err := gk.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	gk = openTest(t, crashed, maxFileSize)
+	defer gk.Close()
+	lost := 0
+	for u, val := range acked {
+		_, ok := findTest(t, gk, u)
+		unsynced := val.FNum == st.CurrentChunk && val.Offset+val.Len > st.SyncedOffset
+		if ok == unsynced {
+			t.Fatal(mode, override, u, "at", val, "is found:", ok, "synced to", st.SyncedOffset)
+		}
+		if !ok {
+			lost += 1
+		}
+	}
+	return lost, st.CurrentChunk
+}
+
+// TestCrashSync checks that the modes waiting for fsync lose nothing.
+func TestCrashSync(t *testing.T) {
+	for _, c := range []struct {
+		mode, override string
+		maxFileSize    uint64
+	}{
+		{DurabilitySync, "", 1 << 20},
+		{DurabilityGroup, "", 1 << 20},
+		{DurabilityGroup, "", 16 << 10},
+		{DurabilitySeal, DurabilitySync, 1 << 20},
+		{DurabilitySeal, DurabilityGroup, 1 << 20},
+	} {
+		if lost, _ := crashTest(t, c.mode, c.override, c.maxFileSize, 0); lost != 0 {
+			t.Fatal(c.mode, c.override, c.maxFileSize, "lost", lost)
+		}
+	}
+}
+
+// TestCrashSeal checks that the seal mode loses what is past the last
+// sealed chunk, a torn record included, and keeps the sealed chunks.
+func TestCrashSeal(t *testing.T) {
+	for _, torn := range []uint64{0, 7} {
+		// nothing is sealed
+		if lost, _ := crashTest(t, DurabilitySeal, "", 1<<20, torn); lost == 0 {
+			t.Fatal("Nothing is lost without fsync, torn", torn)
+		}
+		// crashTest checks that the sealed chunks are kept whole
+		if lost, sealed := crashTest(t, DurabilitySeal, "", 8<<10, torn); lost == 0 || sealed == 0 {
+			t.Fatal("Lost", lost, "with", sealed, "sealed chunks, torn", torn)
+		}
+	}
+}
+
+// TestCloseSyncsGroup closes the gatekeeper under writers, some waiting
+// for group commit. Close synced the records written before it, so those
+// writes succeed and survive, the later ones fail as closed.
+func TestCloseSyncsGroup(t *testing.T) {
+	dir := t.TempDir()
+	gk := openTest(t, dir, 1<<20)
+	if err := gk.SetDurability(DurabilityGroup, 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	const writers = 10
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	acked := []string{}
+	failed := 0
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				u := fmt.Sprintf("http://h%d.ru/%d", w, i)
+				key, _ := UrlTransform(u)
+				var err error
+				if i%2 == 0 {
+					_, err = gk.Write(u, key, nil, []byte("body"))
+				} else {
+					_, errs := gk.WriteAll([]WriteArgs{{FindArgs: FindArgs{Url: u}, Body: "body"}})
+					err = errs[0]
+				}
+
+				mutex.Lock()
+				if err == nil {
+					acked = append(acked, u)
+				} else {
+					failed += 1
+				}
+				mutex.Unlock()
+				if err != nil {
+					if !strings.HasPrefix(err.Error(), "Gatekeeper is closed!") {
+						t.Error(err)
+					}
+					return
+				}
+			}
+		}(w)
+	}
+
+	// the writers are in the middle of writing
+	time.Sleep(50 * time.Millisecond)
+	if err := gk.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if len(acked) == 0 || failed != writers {
+		t.Fatal("Written", len(acked), "failed", failed)
+	}
+
+	gk = openTest(t, dir, 1<<20)
+	defer gk.Close()
+	for _, u := range acked {
+		if _, ok := findTest(t, gk, u); !ok {
+			t.Fatal("Lost", u)
+		}
+	}
+}
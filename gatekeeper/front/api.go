@@ -0,0 +1,121 @@
+package front
+
+import (
+	"net/rpc"
+	"psearch/gatekeeper"
+	"psearch/util"
+	"psearch/util/errors"
+	"psearch/util/log"
+	"time"
+)
+
+// HeartbeatArgs carry the last assignment the gatekeeper got, so a restarted
+// front can rebuild the membership.
+type HeartbeatArgs struct {
+	Addr   string `json:"addr"`
+	FNum   uint   `json:"fnum"`
+	Node   int    `json:"node"`
+	Master string `json:"master"`
+}
+
+// Assignment tells a gatekeeper what it is: the master of a node (Master is
+// its own address), a replica of Master, or a spare (Node is -1).
+type Assignment struct {
+	Node     int      `json:"node"`
+	Master   string   `json:"master"`
+	Replicas []string `json:"replicas"`
+	FNum     uint     `json:"fnum"`
+}
+
+type NodeInfo struct {
+	Node     int      `json:"node"`
+	Master   string   `json:"master"`
+	Replicas []string `json:"replicas"`
+}
+
+type MembersResult struct {
+	Nodes  []NodeInfo `json:"nodes"`
+	Spares []string   `json:"spares"`
+}
+
+type FrontClient struct {
+	*rpc.Client
+}
+
+func NewFrontClient(addr string) (FrontClient, error) {
+	c, err := util.JsonRpcDial(addr)
+	if err != nil {
+		return FrontClient{}, errors.NewErr(err)
+	}
+
+	return FrontClient{c}, nil
+}
+
+func (self *FrontClient) Heartbeat(args HeartbeatArgs) (Assignment, error) {
+	var res Assignment
+	if err := self.Call("FrontServer.Heartbeat", args, &res); err != nil {
+		return Assignment{}, errors.NewErr(err)
+	}
+
+	return res, nil
+}
+
+func (self *FrontClient) Members() (MembersResult, error) {
+	var res MembersResult
+	if err := self.Call("FrontServer.Members", struct{}{}, &res); err != nil {
+		return MembersResult{}, errors.NewErr(err)
+	}
+
+	return res, nil
+}
+
+// RunHeartbeats reports gk to the front as addr and applies the role the
+// front assigns to it.
+func RunHeartbeats(gk *gatekeeper.Gatekeeper, front, addr string, interval time.Duration) error {
+	log.Printf("RunHeartbeats(%v, %v)\n", front, addr)
+	client, err := NewFrontClient(front)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	last := Assignment{Node: -1}
+	for {
+		a, err := client.Heartbeat(HeartbeatArgs{
+			Addr:   addr,
+			FNum:   gk.ChunkNum(),
+			Node:   last.Node,
+			Master: last.Master,
+		})
+		if err != nil {
+			return err
+		}
+
+		if err := apply(gk, addr, a); err != nil {
+			return err
+		}
+
+		last = a
+		time.Sleep(interval)
+	}
+}
+
+// apply makes gk what the front assigned to it.
+func apply(gk *gatekeeper.Gatekeeper, addr string, a Assignment) error {
+	switch {
+	case a.Node != -1 && a.Master == "":
+		// the node has no master yet, wait for it
+	case a.Master == addr:
+		gk.SkipChunks(a.FNum)
+		if err := gk.SetMaster(""); err != nil {
+			return err
+		}
+		gk.SetReplicas(a.Replicas)
+	default:
+		if err := gk.SetMaster(a.Master); err != nil {
+			return err
+		}
+		gk.SetReplicas(nil)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"net/rpc"
+	"psearch/gatekeeper/front"
+	"psearch/util/errors"
+	"psearch/util/graceful"
+	gjsonrpc "psearch/util/graceful/jsonrpc"
+	"psearch/util/log"
+	"strconv"
+	"time"
+)
+
+func main() {
+	var help = flag.Bool("help", false, "print help")
+	var port = flag.Int("port", -1, "port to listen")
+	var nodes = flag.Int("nodes", 1, "number of storage nodes")
+	var replicas = flag.Int("replicas", 1, "number of replicas per node")
+	var timeout = flag.Int("timeout", 3000, "heartbeat timeout before a master is replaced (in ms)")
+	var grace = flag.Int("grace", 30000, "time a dead member keeps its place (in ms)")
+	var gracefulRestart = graceful.SetFlag()
+	flag.Parse()
+
+	if *help || *port == -1 || *nodes <= 0 {
+		flag.PrintDefaults()
+		return
+	}
+
+	fr := front.NewFront(*nodes, *replicas, time.Duration(*timeout)*time.Millisecond, time.Duration(*grace)*time.Millisecond)
+
+	srv := rpc.NewServer()
+	srv.Register(&front.FrontServer{Front: fr})
+	srv.Register(&front.GatekeeperServer{Front: fr})
+
+	server := gjsonrpc.NewServer(srv)
+	graceful.SetSighup(server)
+
+	go func() {
+		if err := fr.Run(time.Duration(*timeout) * time.Millisecond / 3); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	if err := server.ListenAndServe(":"+strconv.Itoa(*port), *gracefulRestart); err != nil {
+		log.Fatal(errors.NewErr(err))
+	}
+
+	if err := graceful.Restart(server); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,685 @@
+package front
+
+import (
+	"psearch/gatekeeper"
+	"psearch/util/errors"
+	"psearch/util/log"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type memberT struct {
+	addr string
+	node int
+	last time.Time
+	fNum uint
+}
+
+type nodeT struct {
+	master   string
+	replicas []string
+	fNum     uint
+	base     uint
+}
+
+type Front struct {
+	nodes    []nodeT
+	ring     *gatekeeper.Ring
+	members  map[string]*memberT
+	replicas int
+	timeout  time.Duration
+	grace    time.Duration
+	mutex    sync.Mutex
+	clients  gatekeeper.GatekeeperClients
+	started  time.Time
+}
+
+func NewFront(nodes, replicas int, timeout, grace time.Duration) *Front {
+	return &Front{
+		nodes:    make([]nodeT, nodes),
+		ring:     gatekeeper.NewRing(nodes),
+		members:  map[string]*memberT{},
+		replicas: replicas,
+		timeout:  timeout,
+		grace:    grace,
+		started:  time.Now(),
+	}
+}
+
+func removeAddr(arr []string, addr string) []string {
+	res := make([]string, 0, len(arr))
+	for _, v := range arr {
+		if v != addr {
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+func hasAddr(arr []string, addr string) bool {
+	for _, v := range arr {
+		if v == addr {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *Front) Heartbeat(args HeartbeatArgs) Assignment {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	addr := args.Addr
+	m, ok := self.members[addr]
+	if !ok {
+		log.Printf("Front.Heartbeat(%+v): new member\n", args)
+		m = &memberT{
+			addr: addr,
+			node: -1,
+		}
+		self.members[addr] = m
+	}
+	m.last = time.Now()
+	m.fNum = args.FNum
+
+	if !ok && args.Node >= 0 && args.Node < len(self.nodes) {
+		m.node = args.Node
+		n := &self.nodes[m.node]
+		if args.Master == addr && n.master == "" && time.Since(self.started) < self.grace {
+			// the front was restarted: trust the member's last assignment
+			n.master = addr
+		} else if n.master != addr && !hasAddr(n.replicas, addr) {
+			// a member removed after the grace period might have missed
+			// writes, it comes back as a replica and resyncs
+			n.replicas = append(n.replicas, addr)
+		}
+	} else if m.node == -1 {
+		self.place(m)
+	} else {
+		// came back in the grace period: keep the old place if possible
+		n := &self.nodes[m.node]
+		if n.master == "" {
+			n.master = addr
+			n.replicas = removeAddr(n.replicas, addr)
+		} else if n.master != addr && !hasAddr(n.replicas, addr) {
+			n.replicas = append(n.replicas, addr)
+		}
+	}
+
+	if m.node != -1 {
+		n := &self.nodes[m.node]
+		if n.master == addr && n.fNum < args.FNum {
+			n.fNum = args.FNum
+		}
+	}
+
+	return self.assignment(m)
+}
+
+func (self *Front) place(m *memberT) {
+	for i := range self.nodes {
+		if self.nodes[i].master == "" {
+			log.Printf("Front.place(%v): master of node %v\n", m.addr, i)
+			m.node = i
+			self.nodes[i].master = m.addr
+			return
+		}
+	}
+
+	best := -1
+	for i := range self.nodes {
+		l := len(self.nodes[i].replicas)
+		if l < self.replicas && (best == -1 || l < len(self.nodes[best].replicas)) {
+			best = i
+		}
+	}
+
+	if best != -1 {
+		log.Printf("Front.place(%v): replica of node %v\n", m.addr, best)
+		m.node = best
+		self.nodes[best].replicas = append(self.nodes[best].replicas, m.addr)
+	}
+}
+
+func (self *Front) assignment(m *memberT) Assignment {
+	if m.node == -1 {
+		return Assignment{Node: -1}
+	}
+
+	n := self.nodes[m.node]
+	res := Assignment{
+		Node:   m.node,
+		Master: n.master,
+		FNum:   n.base,
+	}
+	if n.master == m.addr {
+		res.Replicas = append([]string{}, n.replicas...)
+	}
+	return res
+}
+
+func (self *Front) check() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	now := time.Now()
+	for addr, m := range self.members {
+		dead := now.Sub(m.last)
+		if dead > self.grace {
+			log.Printf("Front.check(): member %v is gone\n", addr)
+			delete(self.members, addr)
+			if m.node != -1 {
+				n := &self.nodes[m.node]
+				n.replicas = removeAddr(n.replicas, addr)
+				if n.master == addr {
+					n.master = ""
+				}
+			}
+			continue
+		}
+
+		if dead > self.timeout && m.node != -1 && self.nodes[m.node].master == addr {
+			if !self.failover(m.node, 0) {
+				log.Errorln("Node " + strconv.Itoa(m.node) + " lost its master " + addr + " and has no alive replicas!")
+			}
+		}
+	}
+
+	if now.Sub(self.started) < self.grace {
+		// the masters might not have come back after a restart yet
+		return
+	}
+	for i := range self.nodes {
+		n := &self.nodes[i]
+		if n.master == "" && len(n.replicas) != 0 {
+			// only a replica that has every chunk the node had may take it
+			self.failover(i, n.fNum)
+		}
+	}
+}
+
+// failover promotes the freshest alive replica of the node that has at
+// least min chunks, if there is one.
+func (self *Front) failover(node int, min uint) bool {
+	n := &self.nodes[node]
+	now := time.Now()
+	var best *memberT
+	for _, addr := range n.replicas {
+		m := self.members[addr]
+		if m == nil || now.Sub(m.last) > self.timeout || m.fNum < min {
+			continue
+		}
+
+		if best == nil || m.fNum > best.fNum {
+			best = m
+		}
+	}
+
+	if best == nil {
+		return false
+	}
+
+	log.Printf("Front.failover(%v): %v -> %v\n", node, n.master, best.addr)
+	n.master = best.addr
+	n.replicas = removeAddr(n.replicas, best.addr)
+	// n.fNum might be the unsealed chunk of the dead master, never reuse it
+	n.base = n.fNum + 1
+	return true
+}
+
+func (self *Front) Run(interval time.Duration) error {
+	log.Printf("Front.Run()\n")
+	for {
+		time.Sleep(interval)
+		self.check()
+	}
+}
+
+func (self *Front) Members() MembersResult {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	res := MembersResult{
+		Nodes:  make([]NodeInfo, len(self.nodes)),
+		Spares: []string{},
+	}
+	for i, n := range self.nodes {
+		res.Nodes[i] = NodeInfo{
+			Node:     i,
+			Master:   n.master,
+			Replicas: append([]string{}, n.replicas...),
+		}
+	}
+
+	for addr, m := range self.members {
+		if m.node == -1 {
+			res.Spares = append(res.Spares, addr)
+		}
+	}
+	sort.Strings(res.Spares)
+	return res
+}
+
+func (self *Front) masterOf(u string) (string, error) {
+	node, err := self.ring.PlaceOf(u)
+	if err != nil {
+		return "", err
+	}
+
+	return self.masterOfNode(node)
+}
+
+func (self *Front) masterOfNode(node int) (string, error) {
+	if node < 0 || node >= len(self.nodes) {
+		return "", errors.New("No node " + strconv.Itoa(node) + "!")
+	}
+
+	self.mutex.Lock()
+	master := self.nodes[node].master
+	self.mutex.Unlock()
+	if master == "" {
+		return "", errors.New("Node " + strconv.Itoa(node) + " has no master!")
+	}
+
+	return master, nil
+}
+
+// Forward calls a GatekeeperServer method on the master of the node owning u.
+func (self *Front) Forward(u, method string, args, result interface{}) error {
+	addr, err := self.masterOf(u)
+	if err != nil {
+		return err
+	}
+
+	return self.call(addr, method, args, result)
+}
+
+func (self *Front) masters() ([]string, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	res := make([]string, len(self.nodes))
+	for i, n := range self.nodes {
+		if n.master == "" {
+			return nil, errors.New("Node " + strconv.Itoa(i) + " has no master!")
+		}
+		res[i] = n.master
+	}
+	return res, nil
+}
+
+// Scan merges the pages of all nodes, since a prefix can span many hosts.
+func (self *Front) Scan(args gatekeeper.ScanArgs) (gatekeeper.ScanResult, error) {
+	addrs, err := self.masters()
+	if err != nil {
+		return gatekeeper.ScanResult{}, err
+	}
+
+	limit := args.Limit
+	if limit <= 0 || limit > gatekeeper.MaxScanLimit {
+		limit = gatekeeper.MaxScanLimit
+	}
+
+	more := false
+	items := []gatekeeper.ScanItem{}
+	for _, addr := range addrs {
+		var r gatekeeper.ScanResult
+		if err := self.call(addr, "Scan", args, &r); err != nil {
+			return gatekeeper.ScanResult{}, err
+		}
+
+		items = append(items, r.Items...)
+		more = more || r.Next != ""
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Key < items[j].Key
+	})
+
+	res := gatekeeper.ScanResult{
+		Items: items,
+	}
+	if len(items) > limit {
+		res.Items = items[:limit]
+		more = true
+	}
+	if more && len(res.Items) != 0 {
+		res.Next = res.Items[len(res.Items)-1].Key
+	}
+	return res, nil
+}
+
+// FindByHash asks every node, bodies are deduplicated only within a node.
+// The value is the one of the first node that has the body.
+func (self *Front) FindByHash(args gatekeeper.FindByHashArgs) (gatekeeper.FindResult, error) {
+	addrs, err := self.masters()
+	if err != nil {
+		return gatekeeper.FindResult{}, err
+	}
+
+	for _, addr := range addrs {
+		var r gatekeeper.FindResult
+		if err := self.call(addr, "FindByHash", args, &r); err != nil {
+			return gatekeeper.FindResult{}, err
+		}
+
+		if r.Val != nil {
+			return r, nil
+		}
+	}
+	return gatekeeper.FindResult{}, nil
+}
+
+// group splits urls by the masters owning them. Urls that can't be routed
+// get an error instead.
+func (self *Front) group(urls []string) (map[string][]int, []error) {
+	res := map[string][]int{}
+	errs := make([]error, len(urls))
+	for i, u := range urls {
+		addr, err := self.masterOf(u)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		res[addr] = append(res[addr], i)
+	}
+	return res, errs
+}
+
+func (self *Front) FindAll(urls []string) []gatekeeper.FindAllResult {
+	res := make([]gatekeeper.FindAllResult, len(urls))
+	groups, errs := self.group(urls)
+	for i, err := range errs {
+		if err != nil {
+			res[i].Error = err.Error()
+		}
+	}
+
+	for addr, idx := range groups {
+		args := gatekeeper.FindAllArgs{
+			Urls: make([]string, len(idx)),
+		}
+		for j, i := range idx {
+			args.Urls[j] = urls[i]
+		}
+
+		var r []gatekeeper.FindAllResult
+		err := self.call(addr, "FindAll", args, &r)
+		for j, i := range idx {
+			if err != nil {
+				res[i].Error = err.Error()
+			} else if j < len(r) {
+				res[i] = r[j]
+			}
+		}
+	}
+	return res
+}
+
+// MightContain asks every node about its urls, bad urls are never there.
+func (self *Front) MightContain(urls []string) []bool {
+	res := make([]bool, len(urls))
+	groups, errs := self.group(urls)
+	for i, err := range errs {
+		if err != nil {
+			// a node without a master might still have the url
+			_, perr := self.ring.PlaceOf(urls[i])
+			res[i] = perr == nil
+		}
+	}
+
+	for addr, idx := range groups {
+		args := gatekeeper.FindAllArgs{
+			Urls: make([]string, len(idx)),
+		}
+		for j, i := range idx {
+			args.Urls[j] = urls[i]
+		}
+
+		var r []bool
+		err := self.call(addr, "MightContain", args, &r)
+		for j, i := range idx {
+			// the node is unknown, so the url might be there
+			res[i] = err != nil || (j < len(r) && r[j])
+		}
+	}
+	return res
+}
+
+func (self *Front) ReadAll(urls []string) []gatekeeper.ReadAllResult {
+	res := make([]gatekeeper.ReadAllResult, len(urls))
+	groups, errs := self.group(urls)
+	for i, err := range errs {
+		if err != nil {
+			res[i].Error = err.Error()
+		}
+	}
+
+	for addr, idx := range groups {
+		args := gatekeeper.FindAllArgs{
+			Urls: make([]string, len(idx)),
+		}
+		for j, i := range idx {
+			args.Urls[j] = urls[i]
+		}
+
+		var r []gatekeeper.ReadAllResult
+		err := self.call(addr, "ReadAll", args, &r)
+		for j, i := range idx {
+			if err != nil {
+				res[i].Error = err.Error()
+			} else if j < len(r) {
+				res[i] = r[j]
+			}
+		}
+	}
+	return res
+}
+
+func (self *Front) WriteAll(docs []gatekeeper.WriteArgs) []gatekeeper.FindAllResult {
+	urls := make([]string, len(docs))
+	for i, d := range docs {
+		urls[i] = d.Url
+	}
+
+	res := make([]gatekeeper.FindAllResult, len(docs))
+	groups, errs := self.group(urls)
+	for i, err := range errs {
+		if err != nil {
+			res[i].Error = err.Error()
+		}
+	}
+
+	for addr, idx := range groups {
+		args := gatekeeper.WriteAllArgs{
+			Docs: make([]gatekeeper.WriteArgs, len(idx)),
+		}
+		for j, i := range idx {
+			args.Docs[j] = docs[i]
+		}
+
+		var r []gatekeeper.FindAllResult
+		err := self.call(addr, "WriteAll", args, &r)
+		for j, i := range idx {
+			if err != nil {
+				res[i].Error = err.Error()
+			} else if j < len(r) {
+				res[i] = r[j]
+			}
+		}
+	}
+	return res
+}
+
+// Changes reads the feed of the master of args.Node. Sequence numbers are
+// per node, a replica taking over keeps them.
+func (self *Front) Changes(args gatekeeper.ChangesArgs) (gatekeeper.ChangesResult, error) {
+	addr, err := self.masterOfNode(args.Node)
+	if err != nil {
+		return gatekeeper.ChangesResult{}, err
+	}
+
+	var res gatekeeper.ChangesResult
+	if err := self.call(addr, "Changes", args, &res); err != nil {
+		return gatekeeper.ChangesResult{}, err
+	}
+	return res, nil
+}
+
+// Health is ok while every node has a master, so the whole api works.
+func (self *Front) Health() gatekeeper.Health {
+	_, err := self.masters()
+	return gatekeeper.Health{
+		Ok:     err == nil,
+		Role:   "front",
+		Uptime: time.Since(self.started).Seconds(),
+	}
+}
+
+func (self *Front) call(addr, method string, args, result interface{}) error {
+	return self.clients.Call(addr, method, args, result)
+}
+
+type FrontServer struct {
+	Front *Front
+}
+
+func (self *FrontServer) Heartbeat(args *HeartbeatArgs, result *Assignment) error {
+	*result = self.Front.Heartbeat(*args)
+	return nil
+}
+
+func (self *FrontServer) Members(args *struct{}, result *MembersResult) error {
+	*result = self.Front.Members()
+	return nil
+}
+
+// GatekeeperServer serves the gatekeeper API, so GatekeeperClient can talk
+// to the front as if it was a single gatekeeper.
+type GatekeeperServer struct {
+	Front *Front
+}
+
+func (self *GatekeeperServer) Find(args *gatekeeper.FindArgs, result *gatekeeper.FindResult) error {
+	if err := self.Front.Forward(args.Url, "Find", args, result); err != nil {
+		log.Errorln(err, args)
+		return err
+	}
+	return nil
+}
+
+func (self *GatekeeperServer) Read(args *gatekeeper.FindArgs, result *gatekeeper.ReadResult) error {
+	if err := self.Front.Forward(args.Url, "Read", args, result); err != nil {
+		log.Errorln(err, args)
+		return err
+	}
+	return nil
+}
+
+func (self *GatekeeperServer) Write(args *gatekeeper.WriteArgs, result *gatekeeper.FindResult) error {
+	if err := self.Front.Forward(args.Url, "Write", args, result); err != nil {
+		log.Errorln(err, args)
+		return err
+	}
+	return nil
+}
+
+func (self *GatekeeperServer) Delete(args *gatekeeper.FindArgs, result *gatekeeper.DeleteResult) error {
+	if err := self.Front.Forward(args.Url, "Delete", args, result); err != nil {
+		log.Errorln(err, args)
+		return err
+	}
+	return nil
+}
+
+func (self *GatekeeperServer) Scan(args *gatekeeper.ScanArgs, result *gatekeeper.ScanResult) error {
+	r, err := self.Front.Scan(*args)
+	if err != nil {
+		log.Errorln(err, args)
+		return err
+	}
+
+	*result = r
+	return nil
+}
+
+func (self *GatekeeperServer) ReadMeta(args *gatekeeper.FindArgs, result *gatekeeper.ReadMetaResult) error {
+	if err := self.Front.Forward(args.Url, "ReadMeta", args, result); err != nil {
+		log.Errorln(err, args)
+		return err
+	}
+	return nil
+}
+
+func (self *GatekeeperServer) ReadVersion(args *gatekeeper.VersionArgs, result *gatekeeper.ReadResult) error {
+	if err := self.Front.Forward(args.Url, "ReadVersion", args, result); err != nil {
+		log.Errorln(err, args)
+		return err
+	}
+	return nil
+}
+
+func (self *GatekeeperServer) ReadRange(args *gatekeeper.ReadRangeArgs, result *gatekeeper.ReadRangeResult) error {
+	if err := self.Front.Forward(args.Url, "ReadRange", args, result); err != nil {
+		log.Errorln(err, args)
+		return err
+	}
+	return nil
+}
+
+func (self *GatekeeperServer) ListVersions(args *gatekeeper.FindArgs, result *gatekeeper.VersionsResult) error {
+	if err := self.Front.Forward(args.Url, "ListVersions", args, result); err != nil {
+		log.Errorln(err, args)
+		return err
+	}
+	return nil
+}
+
+func (self *GatekeeperServer) FindAll(args *gatekeeper.FindAllArgs, result *[]gatekeeper.FindAllResult) error {
+	*result = self.Front.FindAll(args.Urls)
+	return nil
+}
+
+func (self *GatekeeperServer) ReadAll(args *gatekeeper.FindAllArgs, result *[]gatekeeper.ReadAllResult) error {
+	*result = self.Front.ReadAll(args.Urls)
+	return nil
+}
+
+func (self *GatekeeperServer) WriteAll(args *gatekeeper.WriteAllArgs, result *[]gatekeeper.FindAllResult) error {
+	*result = self.Front.WriteAll(args.Docs)
+	return nil
+}
+
+func (self *GatekeeperServer) MightContain(args *gatekeeper.FindAllArgs, result *[]bool) error {
+	*result = self.Front.MightContain(args.Urls)
+	return nil
+}
+
+func (self *GatekeeperServer) FindByHash(args *gatekeeper.FindByHashArgs, result *gatekeeper.FindResult) error {
+	r, err := self.Front.FindByHash(*args)
+	if err != nil {
+		log.Errorln(err, args)
+		return err
+	}
+
+	*result = r
+	return nil
+}
+
+func (self *GatekeeperServer) Changes(args *gatekeeper.ChangesArgs, result *gatekeeper.ChangesResult) error {
+	r, err := self.Front.Changes(*args)
+	if err != nil {
+		log.Errorln(err, args)
+		return err
+	}
+
+	*result = r
+	return nil
+}
+
+func (self *GatekeeperServer) Health(args *struct{}, result *gatekeeper.Health) error {
+	*result = self.Front.Health()
+	return nil
+}
@@ -0,0 +1,259 @@
+package front
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	stdlog "log"
+	"math/rand"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"psearch/gatekeeper"
+	"psearch/util/log"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.Logger = stdlog.New(ioutil.Discard, "", 0)
+	os.Exit(m.Run())
+}
+
+type memberTest struct {
+	addr string
+	gk   *gatekeeper.Gatekeeper
+	last Assignment
+}
+
+// serveMember serves a new gatekeeper with small chunks over json-rpc.
+func serveMember(t *testing.T) *memberTest {
+	gk, err := gatekeeper.NewGatekeeper(t.TempDir(), 8<<10, time.Minute, 0, 1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rpc.NewServer()
+	if err := srv.Register(&gatekeeper.GatekeeperServer{Gatekeeper: gk}); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+		gk.Close()
+	})
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go srv.ServeCodec(jsonrpc.NewServerCodec(c))
+		}
+	}()
+	return &memberTest{
+		addr: l.Addr().String(),
+		gk:   gk,
+		last: Assignment{Node: -1},
+	}
+}
+
+// beat sends a heartbeat of m and applies the answer, as RunHeartbeats does.
+func (self *memberTest) beat(t *testing.T, f *Front) {
+	a := f.Heartbeat(HeartbeatArgs{
+		Addr:   self.addr,
+		FNum:   self.gk.ChunkNum(),
+		Node:   self.last.Node,
+		Master: self.last.Master,
+	})
+	if err := apply(self.gk, self.addr, a); err != nil {
+		t.Fatal(err)
+	}
+	self.last = a
+}
+
+// waitFor runs the heartbeats of alive and the checks of f until cond holds.
+func waitFor(t *testing.T, f *Front, what string, cond func() bool, alive ...*memberTest) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("No", what, f.Members())
+		}
+		for _, m := range alive {
+			m.beat(t, f)
+		}
+		f.check()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func writeFront(t *testing.T, f *Front, from, to int) []string {
+	urls := []string{}
+	for i := from; i < to; i++ {
+		u := fmt.Sprintf("http://h.ru/%d", i)
+		var res gatekeeper.FindResult
+		data := make([]byte, 500)
+		rand.New(rand.NewSource(int64(i))).Read(data)
+		body := hex.EncodeToString(data)
+		if err := f.Forward(u, "Write", gatekeeper.WriteArgs{FindArgs: gatekeeper.FindArgs{Url: u}, Body: body}, &res); err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, u)
+	}
+	return urls
+}
+
+// sealedOn returns the urls of gk that are in its sealed chunks and where.
+func sealedOn(t *testing.T, gk *gatekeeper.Gatekeeper, urls []string) map[string]gatekeeper.Value {
+	sealed := map[uint]bool{}
+	for _, c := range gk.Chunks() {
+		sealed[c.FNum] = true
+	}
+
+	res := map[string]gatekeeper.Value{}
+	for _, u := range urls {
+		key, err := gatekeeper.UrlTransform(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if val, ok := gk.Find(key); ok && sealed[val.FNum] {
+			res[u] = val
+		}
+	}
+	return res
+}
+
+// TestFailover elects a master, fails it over to the freshest replica after
+// the heartbeat timeout and brings the old master back as a replica.
+func TestFailover(t *testing.T) {
+	f := NewFront(1, 2, 100*time.Millisecond, 300*time.Millisecond)
+	g1, g2, g3 := serveMember(t), serveMember(t), serveMember(t)
+	for _, m := range []*memberTest{g1, g2, g3} {
+		m.beat(t, f)
+	}
+	for _, m := range []*memberTest{g1, g2, g3} {
+		if m.last.Node != 0 || m.last.Master != g1.addr {
+			t.Fatal("Election", m.addr, m.last)
+		}
+	}
+
+	first := writeFront(t, f, 0, 100)
+	synced := sealedOn(t, g1.gk, first)
+	if len(synced) == 0 {
+		t.Fatal("Nothing is sealed")
+	}
+	// only g2 catches up, so it is the freshest
+	if err := g2.gk.SyncMaster(); err != nil {
+		t.Fatal(err)
+	}
+	g2.beat(t, f)
+
+	// g1 is gone
+	waitFor(t, f, "failover", func() bool {
+		return f.Members().Nodes[0].Master == g2.addr
+	}, g2, g3)
+	g2.beat(t, f)
+	g3.beat(t, f)
+	if g3.last.Master != g2.addr {
+		t.Fatal("Replica", g3.last)
+	}
+	for u, val := range synced {
+		var res gatekeeper.FindResult
+		if err := f.Forward(u, "Find", gatekeeper.FindArgs{Url: u}, &res); err != nil {
+			t.Fatal(err)
+		}
+		if res.Val == nil || *res.Val != val {
+			t.Fatal("Lost", u, "at", val)
+		}
+	}
+
+	second := writeFront(t, f, 100, 200)
+	waitFor(t, f, "removal", func() bool {
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		_, ok := f.members[g1.addr]
+		return !ok
+	}, g2, g3)
+
+	// the old master rejoins as a replica of the new one and resyncs
+	g1.beat(t, f)
+	if g1.last.Node != 0 || g1.last.Master != g2.addr {
+		t.Fatal("Rejoined", g1.last)
+	}
+	if err := g1.gk.SyncMaster(); err != nil {
+		t.Fatal(err)
+	}
+	moved := sealedOn(t, g2.gk, second)
+	if len(moved) == 0 {
+		t.Fatal("Nothing is sealed")
+	}
+	for u, val := range moved {
+		key, _ := gatekeeper.UrlTransform(u)
+		if got, ok := g1.gk.Find(key); !ok || got != val {
+			t.Fatal("Not synced", u, "at", val, got)
+		}
+	}
+}
+
+// TestStaleMasterRejoins checks that a master removed after the grace period
+// doesn't take the node back with stale data, while a restarted front trusts
+// the last assignments.
+func TestStaleMasterRejoins(t *testing.T) {
+	f := NewFront(1, 1, 50*time.Millisecond, 150*time.Millisecond)
+	beat := func(f *Front, addr string, fNum uint, last Assignment) Assignment {
+		return f.Heartbeat(HeartbeatArgs{Addr: addr, FNum: fNum, Node: last.Node, Master: last.Master})
+	}
+	a := beat(f, "a", 3, Assignment{Node: -1})
+	b := beat(f, "b", 3, Assignment{Node: -1})
+	if a.Master != "a" || b.Master != "a" {
+		t.Fatal("Election", a, b)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for f.Members().Nodes[0].Master != "b" {
+		if time.Now().After(deadline) {
+			t.Fatal("No failover", f.Members())
+		}
+		beat(f, "b", 3, b)
+		f.check()
+		time.Sleep(10 * time.Millisecond)
+	}
+	b = beat(f, "b", 3, b)
+	// the new master skips the chunks of the old one
+	b = beat(f, "b", b.FNum, b)
+
+	// both are gone
+	time.Sleep(200 * time.Millisecond)
+	f.check()
+	if m := f.Members(); m.Nodes[0].Master != "" || len(m.Nodes[0].Replicas) != 0 {
+		t.Fatal("Not removed", m)
+	}
+
+	a = beat(f, "a", 3, a)
+	f.check()
+	if a.Node != 0 || a.Master != "" || f.Members().Nodes[0].Master != "" {
+		t.Fatal("Stale master", a, f.Members())
+	}
+
+	b = beat(f, "b", b.FNum, b)
+	f.check()
+	b = beat(f, "b", b.FNum, b)
+	a = beat(f, "a", 3, a)
+	if b.Master != "b" || a.Master != "b" {
+		t.Fatal("Fresh master", a, b)
+	}
+
+	// a restarted front
+	f = NewFront(1, 1, 50*time.Millisecond, 150*time.Millisecond)
+	a = beat(f, "a", 3, a)
+	b = beat(f, "b", b.FNum, b)
+	a = beat(f, "a", 3, a)
+	if b.Master != "b" || a.Master != "b" {
+		t.Fatal("Restart", a, b)
+	}
+}
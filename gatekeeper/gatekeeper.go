@@ -6,13 +6,14 @@ import (
 	"io/ioutil"
 	"net/url"
 	"os"
-	"psearch/util"
+	"psearch/util/bloom"
 	"psearch/util/errors"
 	"psearch/util/log"
 	"psearch/util/trie"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -35,6 +36,9 @@ type gkFile struct {
 	file   *os.File
 	offset uint64
 	end    time.Time
+	synced time.Time
+	// the offset the last fsync covered
+	durable uint64
 }
 
 func (self *gkFile) WriteLenval(b []byte) (n int, err error) {
@@ -49,17 +53,62 @@ func (self *gkFile) WriteLenval(b []byte) (n int, err error) {
 	return n1 + n2, errors.NewErr(err)
 }
 
+func (self *gkFile) Sync() error {
+	if err := self.file.Sync(); err != nil {
+		return err
+	}
+
+	self.synced = time.Now()
+	self.durable = self.offset
+	return nil
+}
+
 func (self *gkFile) Close() error {
 	return errors.NewErr(self.file.Close())
 }
 
+type chunkT struct {
+	version   int
+	size      uint64
+	live      uint64
+	corrupted uint
+	// bodies before and after compression
+	raw    uint64
+	stored uint64
+}
+
 type Gatekeeper struct {
 	dir         string
 	maxTime     time.Duration
 	maxFileSize uint64
+	versions    int
+	bloomKeys   uint
+	bloomFP     float64
 	fNum        uint
 	file        gkFile
-	trie        trie.Trie
+	trie        trie.Trie[*entryT]
+	bloom       *bloom.Filter
+	chunks      map[uint]*chunkT
+	tombstones  map[string]tombstoneT
+	blobs       map[string]*blobT
+	holds       map[Value]int
+	expiries    expiryHeap
+	ttlRules    *ttlRulesT
+	lock        *os.File
+	readers     readCache
+	bodies      bodyCache
+	changed     chan struct{}
+	reads       latencyT
+	writes      latencyT
+	started     time.Time
+	durability  string
+	group       groupT
+	snapshot    snapshotT
+	mutex       sync.RWMutex
+	master      string
+	replicas    []string
+	// set by Close, nothing is written after it
+	closed bool
 }
 
 type valT struct {
@@ -81,111 +130,286 @@ func (self valTArr) Swap(i, j int) {
 	self[i], self[j] = self[j], self[i]
 }
 
-func NewGatekeeper(dir string, maxFileSize uint64, maxTime time.Duration) (*Gatekeeper, error) {
+// NewGatekeeper keeps up to versions older versions of every url. The bloom
+// filter for missing urls is sized for bloomKeys urls with bloomFP false
+// positive rate.
+func NewGatekeeper(dir string, maxFileSize uint64, maxTime time.Duration, versions int, bloomKeys uint, bloomFP float64) (*Gatekeeper, error) {
+	// a gracefully restarted gatekeeper waits for the old one to exit
+	return newGatekeeper(dir, maxFileSize, maxTime, versions, bloomKeys, bloomFP, true)
+}
+
+// NewGatekeeperNoWait is NewGatekeeper for the offline tools, it fails
+// right away if a gatekeeper or a tool holds dir.
+func NewGatekeeperNoWait(dir string, maxFileSize uint64, maxTime time.Duration, versions int, bloomKeys uint, bloomFP float64) (*Gatekeeper, error) {
+	return newGatekeeper(dir, maxFileSize, maxTime, versions, bloomKeys, bloomFP, false)
+}
+
+func newGatekeeper(dir string, maxFileSize uint64, maxTime time.Duration, versions int, bloomKeys uint, bloomFP float64, wait bool) (*Gatekeeper, error) {
 	self := &Gatekeeper{
 		dir:         dir,
 		maxTime:     maxTime,
 		maxFileSize: maxFileSize,
+		versions:    versions,
+		bloomKeys:   bloomKeys,
+		bloomFP:     bloomFP,
 		fNum:        0,
+		started:     time.Now(),
 	}
 
-	files, err := ioutil.ReadDir(dir)
+	lock, err := lockDir(dir, true, wait)
+	if err != nil {
+		return nil, err
+	}
+	self.lock = lock
+
+	self.resetIndex()
+	if err := self.loadDir(); err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	return self, nil
+}
+
+// resetIndex forgets everything loaded from the chunks.
+func (self *Gatekeeper) resetIndex() {
+	self.trie = trie.Trie[*entryT]{}
+	self.bloom = bloom.New(self.bloomKeys, self.bloomFP)
+	self.chunks = map[uint]*chunkT{}
+	self.tombstones = map[string]tombstoneT{}
+	self.blobs = map[string]*blobT{}
+	self.holds = map[Value]int{}
+	self.expiries = nil
+}
+
+// chunkFiles lists the chunks of the directory in order. The leftovers of an
+// interrupted chunk transfer or snapshot are removed if clean is set.
+func (self *Gatekeeper) chunkFiles(clean bool) (valTArr, error) {
+	files, err := ioutil.ReadDir(self.dir)
 	if err != nil {
 		return nil, errors.NewErr(err)
 	}
 
-	arr := make(valTArr, len(files))
-	for i, f := range files {
+	arr := make(valTArr, 0, len(files))
+	for _, f := range files {
+		if f.Name() == snapshotName || f.Name() == lockName {
+			continue
+		}
+
+		if strings.HasSuffix(f.Name(), tmpSuffix) {
+			if !clean {
+				continue
+			}
+			if err := os.Remove(self.dir + "/" + f.Name()); err != nil {
+				return nil, errors.NewErr(err)
+			}
+			continue
+		}
+
 		num, err := strconv.Atoi(f.Name())
 		if err != nil {
 			return nil, errors.NewErr(err)
 		}
 
-		arr[i] = valT{
+		arr = append(arr, valT{
 			num:  uint(num),
 			file: f,
-		}
+		})
 	}
 
 	sort.Sort(arr)
-	counts := map[uint]uint{}
-	for _, f := range arr {
-		counts[f.num] = 0
+	return arr, nil
+}
+
+func (self *Gatekeeper) loadDir() error {
+	arr, err := self.chunkFiles(true)
+	if err != nil {
+		return err
+	}
+
+	sNum, sOffset, ok := self.loadSnapshot(arr)
+	for i, f := range arr {
 		self.fNum = f.num + 1
-		err := self.load(self.dir+"/"+f.file.Name(), f.num, counts)
+
+		from := uint64(0)
+		if _, covered := self.chunks[f.num]; ok && covered {
+			if f.num != sNum {
+				continue
+			}
+			from = sOffset
+		}
+
+		err := self.load(self.dir+"/"+f.file.Name(), f.num, i == len(arr)-1, from)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
 
-	for k, v := range counts {
-		if v == 0 {
-			if err := os.Remove(self.dir + "/" + strconv.Itoa(int(k))); err != nil {
-				return nil, errors.NewErr(err)
-			}
-		}
+	if err := self.pruneTombstones(); err != nil {
+		return err
 	}
+	self.pruneBlobs()
+	return self.removeDeadChunks()
+}
 
-	return self, nil
+func (self *Gatekeeper) chunkName(num uint) string {
+	return self.dir + "/" + strconv.Itoa(int(num))
 }
 
-func (self *Gatekeeper) load(name string, num uint, counts map[uint]uint) error {
-	log.Printf("Gatekeeper.load(%v, %v)\n", name, num)
-	file, err := util.Open(name)
+func (self *Gatekeeper) removeChunk(num uint) error {
+	if err := os.Remove(self.chunkName(num)); err != nil {
+		return errors.NewErr(err)
+	}
+
+	delete(self.chunks, num)
+	self.readers.drop(num)
+	return nil
+}
+
+func (self *Gatekeeper) live(val Value) {
+	if c, ok := self.chunks[val.FNum]; ok {
+		c.live += val.Len
+	}
+}
+
+func (self *Gatekeeper) unlive(val Value) {
+	if c, ok := self.chunks[val.FNum]; ok && val.Len != 0 {
+		c.live -= val.Len
+	}
+}
+
+// apply updates the index with a record just written or replayed at val.
+func (self *Gatekeeper) apply(key []byte, rec record, val Value) {
+	if rec.flags&flagTombstone != 0 {
+		self.deleteValue(key, val, tombstoneOrigin(rec, val))
+		return
+	}
+
+	self.account(rec, val)
+	if rec.flags&flagHash != 0 && rec.flags&flagRef == 0 {
+		self.registerBlob(string(rec.hash), val)
+	}
+	if rec.flags&flagBlob != 0 {
+		return
+	}
+
+	v := versionT{
+		val:     val,
+		pos:     recordPos(rec, val),
+		expires: rec.expires,
+	}
+	if rec.flags&flagRef != 0 {
+		v.ref = string(rec.hash)
+	}
+	self.setValue(key, v)
+	self.scheduleExpiry(key, v)
+}
+
+func (self *Gatekeeper) account(rec record, val Value) {
+	c := self.chunks[val.FNum]
+	raw, stored := bodySize(rec)
+	c.raw += raw
+	c.stored += stored
+}
+
+// load replays the chunk into the trie starting at offset from, or from the
+// beginning if it is zero. A torn record at the end of the last chunk is
+// what a crash in the middle of a write leaves, so it is cut off; anything
+// broken in other chunks is only reported.
+func (self *Gatekeeper) load(name string, num uint, last bool, from uint64) error {
+	log.Printf("Gatekeeper.load(%v, %v, %v)\n", name, num, from)
+	file, err := openChunk(name)
 	if err != nil {
 		return err
 	}
+	defer file.Close()
+
+	chunk, ok := self.chunks[num]
+	if !ok || from == 0 {
+		chunk = &chunkT{
+			version: file.version,
+			size:    file.offset,
+		}
+		self.chunks[num] = chunk
+	}
+
+	if from > file.offset {
+		if err := file.Seek(from); err != nil {
+			return err
+		}
+	}
 
-	cnt := uint64(0)
 	for {
-		n1, key, err := file.ReadLenval()
+		offset, n, rec, err := file.Next()
 		if err == io.EOF {
 			break
 		}
-		if err != nil {
-			return err
-		}
+		if err == errTornRecord {
+			if last {
+				log.Errorf("Chunk %v: torn record at %v, truncating\n", num, offset)
+				return truncateChunk(name, offset)
+			}
 
-		u, err := UrlTransform(string(key))
+			log.Errorf("Chunk %v: torn record at %v, skipping the rest\n", num, offset)
+			chunk.corrupted += 1
+			break
+		}
+		if err == errCorruptRecord {
+			log.Errorf("Chunk %v: corrupted record at %v (%v bytes), skipping\n", num, offset, n)
+			chunk.size = offset + n
+			chunk.corrupted += 1
+			continue
+		}
 		if err != nil {
 			return err
 		}
 
-		n2, err := file.SkipLenval()
+		u, err := UrlTransform(string(rec.url))
 		if err != nil {
 			return err
 		}
 
-		nv := Value{
+		chunk.size = offset + n
+		self.apply([]byte(u), rec, Value{
 			FNum:   num,
-			Offset: cnt,
-			Len:    n1 + n2,
-		}
-		old := self.trie.Add([]byte(u), nv)
-		if old != nil {
-			old := old.(Value)
-			if old.Len != 0 {
-				counts[old.FNum] -= 1
-			}
-		}
-
-		cnt += n1 + n2
-		counts[num] += 1
+			Offset: offset,
+			Len:    n,
+		})
 	}
 	return nil
 }
 
+// Close closes the current chunk and releases the directory.
 func (self *Gatekeeper) Close() error {
-	return self.file.Close()
-}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
 
-func (self *Gatekeeper) nextFile() error {
-	if err := self.file.Close(); err != nil {
-		return err
+	if self.closed {
+		return nil
 	}
+	self.closed = true
 
-	self.fNum += 1
-	f, err := os.Create(self.dir + "/" + strconv.Itoa(int(self.fNum)))
+	var err error
+	if self.file.file != nil {
+		if err = self.file.Sync(); err != nil {
+			err = errors.NewErr(err)
+		}
+		if cerr := self.file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	self.closeGroup(err)
+	if self.lock != nil {
+		self.lock.Close()
+		self.lock = nil
+	}
+	self.bodies.Close()
+	self.readers.Close()
+	return err
+}
+
+func (self *Gatekeeper) openFile() error {
+	f, err := os.Create(self.chunkName(self.fNum))
 	if err != nil {
 		return errors.NewErr(err)
 	}
@@ -194,103 +418,220 @@ func (self *Gatekeeper) nextFile() error {
 		file:   f,
 		offset: 0,
 		end:    time.Now().Add(self.maxTime),
+		synced: time.Now(),
+	}
+	if err := self.file.WriteHeader(); err != nil {
+		return err
+	}
+
+	self.chunks[self.fNum] = &chunkT{
+		version: chunkV2,
+		size:    self.file.offset,
 	}
 	return nil
 }
 
-func (self *Gatekeeper) Write(url, key string, data []byte) (Value, error) {
-	log.Printf("Gatekeeper.Write(%v, %v)\n", url, key)
+func (self *Gatekeeper) nextFile() error {
+	// the sealed chunk goes to the replicas and stays as is
+	if err := self.file.Sync(); err != nil {
+		return errors.NewErr(err)
+	}
+	if err := self.file.Close(); err != nil {
+		return err
+	}
 
-	if self.file.file == nil {
-		f, err := os.Create(self.dir + "/" + strconv.Itoa(int(self.fNum)))
+	if len(self.replicas) != 0 {
+		go self.pushChunk(self.fNum, self.replicas)
+	}
+
+	self.fNum += 1
+	return self.openFile()
+}
+
+// newRecord makes the record for Write, dedup makes it a reference later.
+func newRecord(url string, meta *Meta, data []byte) (record, error) {
+	rec := record{
+		flags: flagHash,
+		url:   []byte(url),
+		hash:  bodyHash(data),
+		body:  data,
+	}
+	if err := compressBody(&rec); err != nil {
+		return record{}, err
+	}
+	if meta != nil {
+		m, err := encodeMeta(meta)
 		if err != nil {
-			return Value{}, errors.NewErr(err)
+			return record{}, err
 		}
+		rec.flags |= flagMeta
+		rec.meta = m
+	}
+	return rec, nil
+}
+
+// WriteOptions.TTL and Expires are explained in expiry, Durability
+// overrides the mode of the gatekeeper if set. If IfCurrent is set, the
+// write is done only if the current version is *IfCurrent, a zero Value
+// for none, otherwise WriteWith returns a zero Value.
+type WriteOptions struct {
+	TTL        time.Duration
+	Expires    int64
+	Durability string
+	IfCurrent  *Value
+}
+
+func (self *Gatekeeper) Write(url, key string, meta *Meta, data []byte) (Value, error) {
+	return self.WriteWith(url, key, meta, data, WriteOptions{})
+}
+
+// WriteTTL is Write of a document that expires after ttl.
+func (self *Gatekeeper) WriteTTL(url, key string, meta *Meta, data []byte, ttl time.Duration) (Value, error) {
+	return self.WriteWith(url, key, meta, data, WriteOptions{TTL: ttl})
+}
+
+func (self *Gatekeeper) WriteWith(url, key string, meta *Meta, data []byte, opts WriteOptions) (Value, error) {
+	log.Printf("Gatekeeper.Write(%v, %v)\n", url, key)
+	mode, err := self.durabilityOf(opts.Durability)
+	if err != nil {
+		return Value{}, err
+	}
+
+	rec, err := newRecord(url, meta, data)
+	if err != nil {
+		return Value{}, err
+	}
+
+	start := time.Now()
+	self.mutex.Lock()
+	if opts.IfCurrent != nil && !self.isCurrent(key, *opts.IfCurrent) {
+		self.mutex.Unlock()
+		log.Printf("Gatekeeper.Write(%v, %v) OK (the current version is not %+v)\n", url, key, *opts.IfCurrent)
+		return Value{}, nil
+	}
+	self.expiry(&rec, opts.TTL, opts.Expires)
+	self.dedup(&rec)
+	res, err := self.write(key, rec)
+	self.mutex.Unlock()
+	if err == nil {
+		err = self.commit(mode)
+	}
+	self.writes.add(start, 1, err)
+	if err != nil {
+		return Value{}, err
+	}
+
+	log.Printf("Gatekeeper.Write(%v, %v) OK (%+v)\n", url, key, res)
+	return res, nil
+}
+
+func (self *Gatekeeper) write(key string, rec record) (Value, error) {
+	res, err := self.appendRecord(rec)
+	if err != nil {
+		return Value{}, err
+	}
 
-		self.file = gkFile{
-			file:   f,
-			offset: 0,
-			end:    time.Now().Add(self.maxTime),
+	self.apply([]byte(key), rec, res)
+	return res, nil
+}
+
+// appendRecord writes rec to the current chunk without touching the trie.
+func (self *Gatekeeper) appendRecord(rec record) (Value, error) {
+	if self.closed {
+		return Value{}, errors.New("Gatekeeper is closed!")
+	}
+	if self.master != "" {
+		return Value{}, errors.New("Gatekeeper is a read-only replica of " + self.master + "!")
+	}
+
+	if self.file.file == nil {
+		if err := self.openFile(); err != nil {
+			return Value{}, err
 		}
 	} else if self.file.offset >= self.maxFileSize {
 		if err := self.nextFile(); err != nil {
 			return Value{}, err
 		}
 	} else if self.file.end.Before(time.Now()) {
-		if err := self.file.file.Sync(); err != nil {
+		if err := self.file.Sync(); err != nil {
 			return Value{}, errors.NewErr(err)
 		}
 		self.file.end = time.Now().Add(self.maxTime)
 	}
 
 	offset := self.file.offset
-
-	cnt := 0
-	n, err := self.file.WriteLenval([]byte(url))
+	cnt, err := self.file.WriteLenval(encodeRecord(rec))
 	if err != nil {
 		return Value{}, err
 	}
-	cnt += n
-
-	n, err = self.file.WriteLenval(data)
-	if err != nil {
-		return Value{}, err
-	}
-	cnt += n
 
 	self.file.offset += uint64(cnt)
+	self.chunks[self.fNum].size = self.file.offset
+	self.notify()
 
-	res := Value{
+	return Value{
 		FNum:   self.fNum,
 		Offset: offset,
 		Len:    uint64(cnt),
-	}
+	}, nil
+}
 
-	self.trie.Add([]byte(key), res)
+// Read returns the body and the metadata, which is nil for records written
+// without it.
+func (self *Gatekeeper) Read(val Value) (string, *Meta, error) {
+	log.Printf("Gatekeeper.Read(%+v)\n", val)
+	_, body, meta, err := self.readBody(val)
+	if err != nil {
+		return "", nil, err
+	}
 
-	// TODO: remove
-	self.file.file.Sync()
+	log.Printf("Gatekeeper.Read(%+v) OK\n", val)
+	return string(body), meta, nil
+}
 
-	log.Printf("Gatekeeper.Write(%v, %v) OK (%+v)\n", url, key, res)
-	return res, nil
+// readBody returns the url, the raw body and the metadata of the record at val.
+func (self *Gatekeeper) readBody(val Value) ([]byte, []byte, *Meta, error) {
+	start := time.Now()
+	u, body, meta, err := self.loadBody(val)
+	self.reads.add(start, 1, err)
+	return u, body, meta, err
 }
 
-func (self *Gatekeeper) Read(val Value) (string, error) {
-	log.Printf("Gatekeeper.Read(%+v)\n", val)
-	f, err := util.Open(self.dir + "/" + strconv.Itoa(int(val.FNum)))
+func (self *Gatekeeper) loadBody(val Value) ([]byte, []byte, *Meta, error) {
+	rec, err := self.readRecord(val)
 	if err != nil {
-		return "", err
+		return nil, nil, nil, err
 	}
 
-	if _, err := f.Seek(int64(val.Offset), 0); err != nil {
-		return "", err
+	meta, err := decodeMeta(rec)
+	if err != nil {
+		return nil, nil, nil, err
 	}
 
-	if _, err := f.SkipLenval(); err != nil {
-		return "", err
+	blob := rec
+	if rec.flags&flagRef != 0 {
+		if blob, err = self.readRef(rec.hash); err != nil {
+			return nil, nil, nil, err
+		}
 	}
 
-	_, res, err := f.ReadLenval()
+	body, err := rawBody(blob)
 	if err != nil {
-		return "", err
+		return nil, nil, nil, err
 	}
-
-	log.Printf("Gatekeeper.Read(%+v) OK\n", val)
-	return string(res), nil
+	return rec.url, body, meta, nil
 }
 
 func (self *Gatekeeper) Find(key string) (Value, bool) {
 	log.Printf("Gatekeeper.Find(%+v)\n", key)
-	res, ok := self.trie.Find([]byte(key))
+	res, ok := self.Version(key, 0)
 	log.Printf("Gatekeeper.Find(%+v) OK (%v, %v)\n", key, res, ok)
-	if !ok {
-		return Value{}, false
-	}
-
-	return res.(Value), true
+	return res, ok
 }
 
 func (self *Gatekeeper) TrieSize() uint {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
 	return self.trie.Count
 }
 
@@ -313,6 +654,32 @@ func (self *GatekeeperServer) Find(args *FindArgs, result *FindResult) error {
 	return nil
 }
 
+// read calls fn with the n-th version of key until it succeeds or fails for
+// a value that is still the n-th version. It returns false if there is none.
+func (self *GatekeeperServer) read(key string, n int, fn func(Value) error) (bool, error) {
+	for {
+		r, ok := self.Gatekeeper.Version(key, n)
+		if !ok {
+			return false, nil
+		}
+
+		err := fn(r)
+		if err == nil {
+			return true, nil
+		}
+
+		// the merger might have moved the record and removed the chunk
+		nr, ok := self.Gatekeeper.Version(key, n)
+		if !ok {
+			// deleted meanwhile
+			return false, nil
+		}
+		if nr == r {
+			return false, err
+		}
+	}
+}
+
 func (self *GatekeeperServer) Read(args *FindArgs, result *ReadResult) error {
 	key, err := UrlTransform(args.Url)
 	if err != nil {
@@ -320,18 +687,19 @@ func (self *GatekeeperServer) Read(args *FindArgs, result *ReadResult) error {
 		return err
 	}
 
-	r, ok := self.Gatekeeper.Find(key)
-	if !ok {
-		return nil
-	}
+	_, err = self.read(key, 0, func(r Value) error {
+		data, meta, err := self.Gatekeeper.Read(r)
+		if err != nil {
+			return err
+		}
 
-	data, err := self.Gatekeeper.Read(r)
+		*result = ReadResult{FindResult{Val: &r}, &data, meta, 0}
+		return nil
+	})
 	if err != nil {
 		log.Errorln(err, args)
 		return err
 	}
-
-	*result = ReadResult{FindResult{Val: &r}, &data}
 	return nil
 }
 
@@ -342,14 +710,20 @@ func (self *GatekeeperServer) Write(args *WriteArgs, result *FindResult) error {
 		return err
 	}
 
-	r, err := self.Gatekeeper.Write(args.Url, key, []byte(args.Body))
+	r, err := self.Gatekeeper.WriteWith(args.Url, key, args.Meta, args.body(), WriteOptions{
+		TTL:        time.Duration(args.TTL) * time.Second,
+		Expires:    args.Expires,
+		Durability: args.Durability,
+		IfCurrent:  args.IfCurrent,
+	})
 	if err != nil {
 		log.Errorln(err, args)
 		return err
 	}
 
-	*result = FindResult{
-		Val: &r,
+	*result = FindResult{}
+	if r.Len != 0 {
+		result.Val = &r
 	}
 	return nil
 }
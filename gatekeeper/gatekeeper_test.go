@@ -0,0 +1,219 @@
+package gatekeeper
+
+import (
+	"fmt"
+	"io/ioutil"
+	stdlog "log"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"psearch/util/log"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.Logger = stdlog.New(ioutil.Discard, "", 0)
+	os.Exit(m.Run())
+}
+
+func openTest(t testing.TB, dir string, maxFileSize uint64) *Gatekeeper {
+	gk, err := NewGatekeeper(dir, maxFileSize, time.Minute, 0, 1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gk
+}
+
+func writeTest(t testing.TB, gk *Gatekeeper, u, body string) Value {
+	key, err := UrlTransform(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	val, err := gk.Write(u, key, nil, []byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return val
+}
+
+func findTest(t testing.TB, gk *Gatekeeper, u string) (Value, bool) {
+	key, err := UrlTransform(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gk.Find(key)
+}
+
+// serveTest serves gk over json-rpc the way bin does, kill breaks the
+// connections.
+func serveTest(t testing.TB, gk *Gatekeeper) (string, func()) {
+	srv := rpc.NewServer()
+	if err := srv.Register(&GatekeeperServer{Gatekeeper: gk}); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mutex sync.Mutex
+	conns := []net.Conn{}
+	kill := func() {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+		conns = nil
+	}
+	t.Cleanup(func() {
+		l.Close()
+		kill()
+	})
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mutex.Lock()
+			conns = append(conns, c)
+			mutex.Unlock()
+			go srv.ServeCodec(jsonrpc.NewServerCodec(c))
+		}
+	}()
+	return l.Addr().String(), kill
+}
+
+// TestConcurrentClients hammers Write/Find/Read from many clients while the
+// merger, snapshots and stats run, run it with -race.
+func TestConcurrentClients(t *testing.T) {
+	dir := t.TempDir()
+	gk := openTest(t, dir, 2000)
+	addr, _ := serveTest(t, gk)
+
+	stop := make(chan struct{})
+	var bg sync.WaitGroup
+	background := func(fn func() error) {
+		bg.Add(1)
+		go func() {
+			defer bg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := fn(); err != nil {
+					t.Error(err)
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+	background(func() error {
+		return gk.Merge(0.3)
+	})
+	background(gk.WriteSnapshot)
+	background(func() error {
+		gk.Stats()
+		gk.Health()
+		return nil
+	})
+
+	const clients, writes, hosts = 16, 200, 20
+	var wg sync.WaitGroup
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			cl, err := NewGatekeeperClient(addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer cl.Close()
+
+			for i := 0; i < writes; i++ {
+				u := fmt.Sprintf("http://h%d.ru/%d", i%hosts, c)
+				body := fmt.Sprintf("body %d of %d", i, c)
+				if _, err := cl.Write(u, body); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, ok, err := cl.Find(u); !ok || err != nil {
+					t.Error("Find", u, ok, err)
+					return
+				}
+				// nobody else writes u, so the body is ours
+				if _, ok, b, err := cl.Read(u); !ok || err != nil || b != body {
+					t.Error("Read", u, ok, b, err)
+					return
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+	close(stop)
+	bg.Wait()
+
+	if err := gk.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	gk = openTest(t, dir, 2000)
+	defer gk.Close()
+	for c := 0; c < clients; c++ {
+		for h := 0; h < hosts; h++ {
+			u := fmt.Sprintf("http://h%d.ru/%d", h, c)
+			val, ok := findTest(t, gk, u)
+			if !ok {
+				t.Fatal("Lost", u)
+			}
+
+			last := writes - hosts + h
+			if body, _, err := gk.Read(val); err != nil || body != fmt.Sprintf("body %d of %d", last, c) {
+				t.Fatal("Read after restart", u, body, err)
+			}
+		}
+	}
+}
+
+// TestWriteIfCurrent checks that a write conditional on the current version
+// is skipped once another one comes.
+func TestWriteIfCurrent(t *testing.T) {
+	gk := openTest(t, t.TempDir(), 1<<20)
+	defer gk.Close()
+
+	const u = "http://a.ru/"
+	key, _ := UrlTransform(u)
+	write := func(body string, cur Value) Value {
+		val, err := gk.WriteWith(u, key, nil, []byte(body), WriteOptions{IfCurrent: &cur})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return val
+	}
+
+	first := write("first", Value{})
+	if first.Len == 0 {
+		t.Fatal("Not written to an empty key")
+	}
+	if val := write("second", Value{}); val.Len != 0 {
+		t.Fatal("Written over", first)
+	}
+	second := write("second", first)
+	if second.Len == 0 {
+		t.Fatal("Not written over", first)
+	}
+	if val := write("third", first); val.Len != 0 {
+		t.Fatal("Written over", second, "as if it was", first)
+	}
+}
@@ -0,0 +1,304 @@
+package gatekeeper
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"psearch/util/errors"
+	"sort"
+	"syscall"
+)
+
+const lockName = "lock"
+
+// the offline tools don't know the server settings, only the ratio matters
+const (
+	inspectBloomKeys = 1000 * 1000
+	inspectBloomFP   = 0.01
+)
+
+// DumpRecord is a record of a chunk as the offline tool shows it. Body is
+// set only if asked for, references have none.
+type DumpRecord struct {
+	Url       string  `json:"url"`
+	Chunk     uint    `json:"chunk"`
+	Offset    uint64  `json:"offset"`
+	Len       uint64  `json:"len"`
+	Live      bool    `json:"live"`
+	Tombstone bool    `json:"tombstone,omitempty"`
+	Moved     bool    `json:"moved,omitempty"`
+	Blob      bool    `json:"blob,omitempty"`
+	Ref       string  `json:"ref,omitempty"`
+	Hash      string  `json:"hash,omitempty"`
+	Expires   int64   `json:"expires,omitempty"`
+	Meta      *Meta   `json:"meta,omitempty"`
+	Body      *string `json:"body,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// lockDir makes sure only one gatekeeper works with dir and the offline
+// tools don't read it meanwhile. Tools share the lock and don't wait for it,
+// a gatekeeper takes it exclusively and waits only if wait is set.
+func lockDir(dir string, exclusive, wait bool) (*os.File, error) {
+	f, err := os.OpenFile(dir+"/"+lockName, os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.NewErr(err)
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK && exclusive {
+			return nil, errors.New("Directory " + dir + " is held by a gatekeeper or a tool!")
+		}
+		if err == syscall.EWOULDBLOCK {
+			return nil, errors.New("Directory " + dir + " is held by a gatekeeper!")
+		}
+		return nil, errors.NewErr(err)
+	}
+	return f, nil
+}
+
+// Inspect loads dir like NewGatekeeper for the offline tools, but changes
+// nothing there: torn records are not cut off, the snapshot is not used and
+// dead chunks stay. It fails if a gatekeeper holds dir.
+func Inspect(dir string, versions int) (*Gatekeeper, error) {
+	lock, err := lockDir(dir, false, false)
+	if err != nil {
+		return nil, err
+	}
+
+	self := &Gatekeeper{
+		dir:       dir,
+		versions:  versions,
+		bloomKeys: inspectBloomKeys,
+		bloomFP:   inspectBloomFP,
+		lock:      lock,
+	}
+	self.resetIndex()
+
+	arr, err := self.chunkFiles(false)
+	if err != nil {
+		self.Close()
+		return nil, err
+	}
+
+	for _, f := range arr {
+		self.fNum = f.num + 1
+		if err := self.load(self.chunkName(f.num), f.num, false, 0); err != nil {
+			self.Close()
+			return nil, err
+		}
+	}
+
+	if err := self.pruneTombstones(); err != nil {
+		self.Close()
+		return nil, err
+	}
+	self.pruneBlobs()
+	return self, nil
+}
+
+func (self *Gatekeeper) chunkNums() []uint {
+	res := make([]uint, 0, len(self.chunks))
+	for num := range self.chunks {
+		res = append(res, num)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i] < res[j]
+	})
+	return res
+}
+
+// reason is the message of err without the callstack.
+func reason(err error) string {
+	if e, ok := err.(errors.ErrorT); ok {
+		return e.Reason().Error()
+	}
+	return err.Error()
+}
+
+// isLive tells if the record at val is needed by the index.
+func (self *Gatekeeper) isLive(key []byte, rec record, val Value) bool {
+	if rec.flags&flagTombstone != 0 {
+		t, ok := self.tombstones[string(key)]
+		return ok && t.val == val
+	}
+	return self.holds[val] > 0
+}
+
+// Dump calls fn for every record of the chunk num, broken ones have Error set.
+func (self *Gatekeeper) Dump(num uint, bodies bool, fn func(DumpRecord) error) error {
+	file, err := openChunk(self.chunkName(num))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	for {
+		offset, n, rec, err := file.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		res := DumpRecord{
+			Url:    string(rec.url),
+			Chunk:  num,
+			Offset: offset,
+			Len:    n,
+		}
+		if err == errTornRecord || err == errCorruptRecord {
+			res.Error = reason(err)
+			if err := fn(res); err != nil {
+				return err
+			}
+			if err == errTornRecord {
+				return nil
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := self.dumpRecord(&res, rec, bodies); err != nil {
+			res.Error = reason(err)
+		}
+		if err := fn(res); err != nil {
+			return err
+		}
+	}
+}
+
+func (self *Gatekeeper) dumpRecord(res *DumpRecord, rec record, bodies bool) error {
+	res.Tombstone = rec.flags&flagTombstone != 0
+	res.Moved = rec.flags&flagMoved != 0
+	res.Blob = rec.flags&flagBlob != 0
+	res.Expires = rec.expires
+	if rec.flags&flagRef != 0 {
+		res.Ref = hex.EncodeToString(rec.hash)
+	} else if rec.flags&flagHash != 0 {
+		res.Hash = hex.EncodeToString(rec.hash)
+	}
+
+	key, err := UrlTransform(res.Url)
+	if err != nil {
+		return err
+	}
+	res.Live = self.isLive([]byte(key), rec, Value{FNum: res.Chunk, Offset: res.Offset, Len: res.Len})
+
+	if res.Meta, err = decodeMeta(rec); err != nil {
+		return err
+	}
+
+	if !bodies || res.Tombstone || res.Ref != "" {
+		return nil
+	}
+
+	body, err := rawBody(rec)
+	if err != nil {
+		return err
+	}
+	s := string(body)
+	res.Body = &s
+	return nil
+}
+
+// checkRecord decodes everything in rec and checks the body hash and the
+// reference.
+func (self *Gatekeeper) checkRecord(rec record) error {
+	if _, err := UrlTransform(string(rec.url)); err != nil {
+		return err
+	}
+
+	if _, err := decodeMeta(rec); err != nil {
+		return err
+	}
+
+	if rec.flags&flagTombstone != 0 {
+		return nil
+	}
+
+	if rec.flags&flagRef != 0 {
+		if b, ok := self.blobs[string(rec.hash)]; !ok || b.val.Len == 0 {
+			return errors.New("Body of the reference " + hex.EncodeToString(rec.hash) + " is lost!")
+		}
+		return nil
+	}
+
+	body, err := rawBody(rec)
+	if err != nil {
+		return err
+	}
+
+	if rec.flags&flagHash != 0 && !bytes.Equal(bodyHash(body), rec.hash) {
+		return errors.New("Body hash mismatch!")
+	}
+	return nil
+}
+
+// Verify reads every record of every chunk and the snapshot, and returns the
+// problems found.
+func (self *Gatekeeper) Verify() ([]string, error) {
+	res := []string{}
+	for _, num := range self.chunkNums() {
+		file, err := openChunk(self.chunkName(num))
+		if err != nil {
+			return nil, err
+		}
+
+		for {
+			offset, n, rec, err := file.Next()
+			if err == io.EOF {
+				break
+			}
+			if err == errTornRecord {
+				res = append(res, fmt.Sprintf("chunk %v: torn record at %v", num, offset))
+				break
+			}
+			if err == errCorruptRecord {
+				res = append(res, fmt.Sprintf("chunk %v: corrupted record at %v (%v bytes)", num, offset, n))
+				continue
+			}
+			if err != nil {
+				file.Close()
+				return nil, err
+			}
+
+			if err := self.checkRecord(rec); err != nil {
+				res = append(res, fmt.Sprintf("chunk %v: record at %v (%v): %v", num, offset, string(rec.url), reason(err)))
+			}
+		}
+		file.Close()
+	}
+
+	if _, err := os.Stat(self.dir + "/" + snapshotName); err == nil {
+		arr, err := self.chunkFiles(false)
+		if err != nil {
+			return nil, err
+		}
+
+		snap := &Gatekeeper{
+			dir:       self.dir,
+			versions:  self.versions,
+			bloomKeys: self.bloomKeys,
+			bloomFP:   self.bloomFP,
+		}
+		snap.resetIndex()
+		if _, _, ok := snap.loadSnapshot(arr); !ok {
+			res = append(res, "snapshot is not usable")
+		}
+	}
+
+	return res, nil
+}
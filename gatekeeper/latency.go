@@ -0,0 +1,44 @@
+package gatekeeper
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// upper bounds of the latency buckets in milliseconds, the last bucket is
+// for the slower calls
+var latencyBounds = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 25, 50, 100, 250, 500, 1000}
+
+// latencyT counts the calls of an operation without locks, readers hold only
+// the read lock.
+type latencyT struct {
+	ops     uint64
+	errors  uint64
+	sum     uint64
+	buckets [14]uint64
+}
+
+// add records a call that started at start and did n operations.
+func (self *latencyT) add(start time.Time, n int, err error) {
+	d := time.Since(start)
+	i := sort.SearchFloat64s(latencyBounds, float64(d)/float64(time.Millisecond))
+	atomic.AddUint64(&self.buckets[i], 1)
+	atomic.AddUint64(&self.sum, uint64(d))
+	atomic.AddUint64(&self.ops, uint64(n))
+	if err != nil {
+		atomic.AddUint64(&self.errors, 1)
+	}
+}
+
+func (self *latencyT) histogram() Histogram {
+	res := Histogram{
+		Bounds: latencyBounds,
+		Counts: make([]uint64, len(self.buckets)),
+		SumMs:  float64(atomic.LoadUint64(&self.sum)) / float64(time.Millisecond),
+	}
+	for i := range self.buckets {
+		res.Counts[i] = atomic.LoadUint64(&self.buckets[i])
+	}
+	return res
+}
@@ -0,0 +1,201 @@
+package gatekeeper
+
+import (
+	"io"
+	"psearch/util/errors"
+	"psearch/util/log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// mergeCandidates returns sealed chunks where at least minDead of the bytes
+// are overwritten, oldest first.
+func (self *Gatekeeper) mergeCandidates(minDead float64) []uint {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	// replicas get merged chunks from the master
+	if self.master != "" {
+		return nil
+	}
+
+	res := []uint{}
+	for num, c := range self.chunks {
+		if self.file.file != nil && num == self.fNum {
+			continue
+		}
+
+		if c.size == 0 || float64(c.size-c.live) < minDead*float64(c.size) {
+			continue
+		}
+
+		res = append(res, num)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i] < res[j]
+	})
+	return res
+}
+
+func (self *Gatekeeper) Merge(minDead float64) error {
+	if _, err := self.Expire(); err != nil {
+		return err
+	}
+
+	self.mutex.Lock()
+	if self.master == "" {
+		if err := self.pruneTombstones(); err != nil {
+			self.mutex.Unlock()
+			return err
+		}
+	}
+	self.pruneBlobs()
+	self.mutex.Unlock()
+
+	for _, num := range self.mergeCandidates(minDead) {
+		if err := self.mergeChunk(num); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *Gatekeeper) mergeChunk(num uint) error {
+	log.Printf("Gatekeeper.mergeChunk(%v)\n", num)
+	file, err := openChunk(self.chunkName(num))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	moved := 0
+	for {
+		offset, n, rec, err := file.Next()
+		if err == io.EOF || err == errTornRecord {
+			break
+		}
+		if err == errCorruptRecord {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		key, err := UrlTransform(string(rec.url))
+		if err != nil {
+			return err
+		}
+
+		old := Value{
+			FNum:   num,
+			Offset: offset,
+			Len:    n,
+		}
+		ok, err := self.moveRecord(key, rec, old)
+		if err != nil {
+			return err
+		}
+		if ok {
+			moved += 1
+		}
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	// copies must hit the disk before the only other copy is gone
+	if self.file.file != nil {
+		if err := self.file.Sync(); err != nil {
+			return errors.NewErr(err)
+		}
+	}
+
+	if c, ok := self.chunks[num]; ok && c.live != 0 {
+		return errors.New("Chunk " + strconv.Itoa(int(num)) + " still has " + strconv.FormatUint(c.live, 10) + " live bytes after merge!")
+	}
+
+	if err := self.removeChunk(num); err != nil {
+		return err
+	}
+
+	log.Printf("Gatekeeper.mergeChunk(%v) OK (%v moved)\n", num, moved)
+	return nil
+}
+
+// moveRecord rewrites the record into the current chunk if it is still one
+// of the versions of key or holds a body for references, i.e. it was not
+// dropped since the merge started. Tombstones are moved only while they
+// still hide something.
+func (self *Gatekeeper) moveRecord(key string, rec record, old Value) (bool, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if rec.flags&flagTombstone != 0 {
+		t, ok := self.tombstones[key]
+		if !ok || t.val != old {
+			return false, nil
+		}
+
+		if !self.tombstoneNeeded(t) {
+			return false, self.forgetTombstone(key, t)
+		}
+
+		if _, err := self.write(key, rec); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	i := -1
+	e, ok := self.findEntry([]byte(key))
+	if ok {
+		i = e.find(old)
+	}
+
+	// references of other urls might still need the body
+	var b *blobT
+	if rec.flags&flagHash != 0 && rec.flags&flagRef == 0 {
+		if bb, ok := self.blobs[string(rec.hash)]; ok && bb.val == old {
+			b = bb
+		}
+	}
+
+	if self.holds[old] == 0 {
+		return false, nil
+	}
+
+	if i != -1 {
+		// the copy keeps the place of the original among the versions
+		rec.flags = rec.flags&^flagBlob | flagMoved
+		rec.pos = e.versions[i].pos
+	} else {
+		rec.flags = rec.flags&^flagMoved | flagBlob
+	}
+
+	val, err := self.appendRecord(rec)
+	if err != nil {
+		return false, err
+	}
+
+	self.account(rec, val)
+	self.moveHolds(old, val)
+	if i != -1 {
+		e.versions[i].val = val
+	}
+	if b != nil {
+		b.val = val
+	}
+	return true, nil
+}
+
+func (self *Gatekeeper) RunMerger(interval time.Duration, minDead float64) error {
+	log.Printf("Gatekeeper.RunMerger()\n")
+	for {
+		time.Sleep(interval)
+		if err := self.Merge(minDead); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package gatekeeper
+
+import (
+	"encoding/json"
+	"psearch/util/errors"
+	"psearch/util/log"
+)
+
+func encodeMeta(meta *Meta) ([]byte, error) {
+	res, err := json.Marshal(meta)
+	if err != nil {
+		return nil, errors.NewErr(err)
+	}
+	return res, nil
+}
+
+func decodeMeta(rec record) (*Meta, error) {
+	if rec.flags&flagMeta == 0 {
+		return nil, nil
+	}
+
+	res := &Meta{}
+	if err := json.Unmarshal(rec.meta, res); err != nil {
+		return nil, errors.NewErr(err)
+	}
+	return res, nil
+}
+
+func (self *Gatekeeper) ReadMeta(val Value) (*Meta, error) {
+	log.Printf("Gatekeeper.ReadMeta(%+v)\n", val)
+	rec, err := self.readRecord(val)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := decodeMeta(rec)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Gatekeeper.ReadMeta(%+v) OK\n", val)
+	return meta, nil
+}
+
+func (self *GatekeeperServer) ReadMeta(args *FindArgs, result *ReadMetaResult) error {
+	key, err := UrlTransform(args.Url)
+	if err != nil {
+		log.Errorln(err, args)
+		return err
+	}
+
+	_, err = self.read(key, 0, func(r Value) error {
+		meta, err := self.Gatekeeper.ReadMeta(r)
+		if err != nil {
+			return err
+		}
+
+		*result = ReadMetaResult{FindResult{Val: &r}, meta}
+		return nil
+	})
+	if err != nil {
+		log.Errorln(err, args)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package gatekeeper
+
+import (
+	"container/list"
+	"io"
+	"os"
+	"psearch/util/errors"
+	"strconv"
+	"sync"
+)
+
+// maxOpenChunks bounds the chunk files kept open for reads.
+const maxOpenChunks = 64
+
+type handleT struct {
+	num  uint
+	file *os.File
+	refs int
+	// evicted or the chunk is removed, closed when the last read is done
+	dead bool
+	elem *list.Element
+}
+
+// readCache keeps the recently read chunks open. A read holds its handle,
+// so the merger removing the chunk meanwhile doesn't break it: the file is
+// closed after the read and the next one fails to open it.
+type readCache struct {
+	mutex sync.Mutex
+	files map[uint]*handleT
+	lru   list.List
+}
+
+func (self *readCache) acquire(name string, num uint) (*handleT, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if h, ok := self.files[num]; ok {
+		h.refs += 1
+		self.lru.MoveToFront(h.elem)
+		return h, nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, errors.NewErr(err)
+	}
+
+	if self.files == nil {
+		self.files = map[uint]*handleT{}
+	}
+	h := &handleT{
+		num:  num,
+		file: f,
+		refs: 1,
+	}
+	h.elem = self.lru.PushFront(h)
+	self.files[num] = h
+
+	for self.lru.Len() > maxOpenChunks {
+		self.evict(self.lru.Back().Value.(*handleT))
+	}
+	return h, nil
+}
+
+func (self *readCache) release(h *handleT) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	h.refs -= 1
+	if h.dead && h.refs == 0 {
+		h.file.Close()
+	}
+}
+
+func (self *readCache) evict(h *handleT) {
+	self.lru.Remove(h.elem)
+	delete(self.files, h.num)
+	h.dead = true
+	if h.refs == 0 {
+		h.file.Close()
+	}
+}
+
+// drop forgets the chunk num, it must be called when the file is removed.
+func (self *readCache) drop(num uint) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if h, ok := self.files[num]; ok {
+		self.evict(h)
+	}
+}
+
+func (self *readCache) Close() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for _, h := range self.files {
+		self.evict(h)
+	}
+}
+
+// chunkVersion returns the format of the chunk of val, checking that val is
+// inside of it.
+func (self *Gatekeeper) chunkVersion(val Value) (int, error) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	// the chunk is removed or val is made up
+	c, ok := self.chunks[val.FNum]
+	if !ok {
+		return 0, errors.New("Chunk " + strconv.FormatUint(uint64(val.FNum), 10) + " is not found!")
+	}
+	if val.Len == 0 || val.Offset > c.size || val.Len > c.size-val.Offset {
+		return 0, errors.New("Record " + val.name() + " is out of its chunk!")
+	}
+	return c.version, nil
+}
+
+// readRecord reads the record at val with one ReadAt, val.Len is all of it.
+func (self *Gatekeeper) readRecord(val Value) (record, error) {
+	version, err := self.chunkVersion(val)
+	if err != nil {
+		return record{}, err
+	}
+
+	h, err := self.readers.acquire(self.chunkName(val.FNum), val.FNum)
+	if err != nil {
+		return record{}, err
+	}
+	defer self.readers.release(h)
+
+	buf := make([]byte, val.Len)
+	if _, err := h.file.ReadAt(buf, int64(val.Offset)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return record{}, errors.NewErr(err)
+	}
+
+	rec, err := parseRecord(buf, version)
+	if err != nil {
+		return record{}, errors.NewErr(err)
+	}
+	return rec, nil
+}
@@ -0,0 +1,137 @@
+package gatekeeper
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+const (
+	benchRecords    = 5000
+	benchRecordSize = 2048
+)
+
+// benchGatekeeper writes 2KB records of random bytes over 10 chunks.
+func benchGatekeeper(b *testing.B) (*Gatekeeper, []Value) {
+	gk := openTest(b, b.TempDir(), benchRecords*benchRecordSize/10)
+	r := rand.New(rand.NewSource(1))
+	if err := gk.SetDurability(DurabilitySeal, 0); err != nil {
+		b.Fatal(err)
+	}
+
+	vals := make([]Value, benchRecords)
+	body := make([]byte, benchRecordSize)
+	for i := range vals {
+		r.Read(body)
+		vals[i] = writeTest(b, gk, fmt.Sprintf("http://h%d.ru/%d", i%100, i), string(body))
+	}
+	return gk, vals
+}
+
+// oldFileReader is util.FileReader before the cache: unbuffered, a read
+// syscall for every byte of a length prefix.
+type oldFileReader struct {
+	file *os.File
+	buf  []byte
+}
+
+func (self *oldFileReader) ReadByte() (byte, error) {
+	n, err := self.file.Read(self.buf)
+	if err != nil {
+		return 0, err
+	}
+	if n != 1 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return self.buf[0], nil
+}
+
+// readOld is readRecord before the cache: the chunk is stat'ed, opened and
+// its magic read for every record, which is then sought to and read through
+// oldFileReader.
+func readOld(gk *Gatekeeper, val Value) (record, error) {
+	name := gk.chunkName(val.FNum)
+	info, err := os.Stat(name)
+	if err != nil {
+		return record{}, err
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return record{}, err
+	}
+	defer f.Close()
+	r := &oldFileReader{file: f, buf: []byte{0}}
+
+	magic := make([]byte, len(chunkMagic))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return record{}, err
+	}
+	if _, err := f.Seek(int64(val.Offset), io.SeekStart); err != nil {
+		return record{}, err
+	}
+
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return record{}, err
+	}
+	if l > uint64(info.Size())-val.Offset {
+		return record{}, errCorruptRecord
+	}
+
+	payload := make([]byte, l)
+	if _, err := f.Read(payload); err != nil {
+		return record{}, err
+	}
+	return decodeRecord(payload)
+}
+
+func benchRead(b *testing.B, gk *Gatekeeper, vals []Value, read func(*Gatekeeper, Value) (record, error)) {
+	r := rand.New(rand.NewSource(2))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := read(gk, vals[r.Intn(len(vals))]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchReadParallel(b *testing.B, gk *Gatekeeper, vals []Value, read func(*Gatekeeper, Value) (record, error)) {
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			if _, err := read(gk, vals[r.Intn(len(vals))]); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+// BenchmarkRead compares random reads the way they were done before the
+// cache of open chunks with reads through it:
+//
+//	go test -run - -bench Read psearch/gatekeeper
+func BenchmarkRead(b *testing.B) {
+	gk, vals := benchGatekeeper(b)
+	defer gk.Close()
+
+	cached := (*Gatekeeper).readRecord
+	b.Run("old", func(b *testing.B) {
+		benchRead(b, gk, vals, readOld)
+	})
+	b.Run("cache", func(b *testing.B) {
+		benchRead(b, gk, vals, cached)
+	})
+	b.Run("old-parallel", func(b *testing.B) {
+		benchReadParallel(b, gk, vals, readOld)
+	})
+	b.Run("cache-parallel", func(b *testing.B) {
+		benchReadParallel(b, gk, vals, cached)
+	})
+}
@@ -0,0 +1,414 @@
+package gatekeeper
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"psearch/util"
+	"psearch/util/errors"
+)
+
+// Chunk format versions. Version 1 chunks have no header and store records
+// as lenval(url) lenval(body). Version 2 chunks start with chunkMagic and
+// store every record as lenval(crc32 flags lenval(url) lenval(body)), the
+// crc covering everything after itself. Flags can add fields, see below.
+const (
+	chunkV1 = 1
+	chunkV2 = 2
+)
+
+var chunkMagic = []byte{0, 'g', 'k', chunkV2}
+
+// Record flags.
+const (
+	// the url was deleted, the body is uvarint(origin), see tombstoneT
+	flagTombstone = 1 << iota
+	// lenval(meta) goes between the url and the body, meta is json of Meta
+	flagMeta
+	// the body is uvarint(raw length) and the flate of the raw body
+	flagCompressed
+	// the merger copied the record, uvarint(fnum) uvarint(offset) of the
+	// original go between the url and the meta
+	flagMoved
+	// lenval(hash) of the raw body goes between the meta and the body
+	flagHash
+	// the body is empty, it is stored in the record of the blob with the hash
+	flagRef
+	// the record only holds a body for references, it is not a version of the url
+	flagBlob
+	// uvarint(unix time) when the url expires goes between the hash and the body
+	flagExpires
+)
+
+// Smaller bodies are not worth compressing.
+const minCompressSize = 256
+
+var errTornRecord = errors.New("Torn record!")
+var errCorruptRecord = errors.New("Record checksum mismatch!")
+
+type record struct {
+	flags   byte
+	url     []byte
+	pos     Value
+	meta    []byte
+	hash    []byte
+	expires int64
+	body    []byte
+}
+
+func appendLenval(buf []byte, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+func readLenval(buf []byte) ([]byte, []byte, bool) {
+	l, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < l {
+		return nil, nil, false
+	}
+
+	return buf[n : n+int(l)], buf[n+int(l):], true
+}
+
+func encodeRecord(rec record) []byte {
+	buf := make([]byte, 4, 5+7*binary.MaxVarintLen64+len(rec.url)+len(rec.meta)+len(rec.hash)+len(rec.body))
+	buf = append(buf, rec.flags)
+	buf = appendLenval(buf, rec.url)
+	if rec.flags&flagMoved != 0 {
+		buf = binary.AppendUvarint(buf, uint64(rec.pos.FNum))
+		buf = binary.AppendUvarint(buf, rec.pos.Offset)
+	}
+	if rec.flags&flagMeta != 0 {
+		buf = appendLenval(buf, rec.meta)
+	}
+	if rec.flags&flagHash != 0 {
+		buf = appendLenval(buf, rec.hash)
+	}
+	if rec.flags&flagExpires != 0 {
+		buf = binary.AppendUvarint(buf, uint64(rec.expires))
+	}
+	buf = appendLenval(buf, rec.body)
+	binary.LittleEndian.PutUint32(buf, crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+func decodeRecord(data []byte) (record, error) {
+	if len(data) < 5 || binary.LittleEndian.Uint32(data) != crc32.ChecksumIEEE(data[4:]) {
+		return record{}, errCorruptRecord
+	}
+
+	res, rest, err := decodeHead(data)
+	if err != nil {
+		return record{}, err
+	}
+
+	var ok bool
+	if res.body, rest, ok = readLenval(rest); !ok {
+		return record{}, errCorruptRecord
+	}
+	return res, nil
+}
+
+// decodeHead decodes the fields before the body without checking the crc,
+// the rest starts with lenval(body).
+func decodeHead(data []byte) (record, []byte, error) {
+	if len(data) < 5 {
+		return record{}, nil, errCorruptRecord
+	}
+
+	res := record{
+		flags: data[4],
+	}
+
+	var ok bool
+	rest := data[5:]
+	if res.url, rest, ok = readLenval(rest); !ok {
+		return record{}, nil, errCorruptRecord
+	}
+	if res.flags&flagMoved != 0 {
+		fnum, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return record{}, nil, errCorruptRecord
+		}
+		offset, m := binary.Uvarint(rest[n:])
+		if m <= 0 {
+			return record{}, nil, errCorruptRecord
+		}
+		res.pos = Value{
+			FNum:   uint(fnum),
+			Offset: offset,
+		}
+		rest = rest[n+m:]
+	}
+	if res.flags&flagMeta != 0 {
+		if res.meta, rest, ok = readLenval(rest); !ok {
+			return record{}, nil, errCorruptRecord
+		}
+	}
+	if res.flags&flagHash != 0 {
+		if res.hash, rest, ok = readLenval(rest); !ok {
+			return record{}, nil, errCorruptRecord
+		}
+	}
+	if res.flags&flagExpires != 0 {
+		expires, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return record{}, nil, errCorruptRecord
+		}
+		res.expires = int64(expires)
+		rest = rest[n:]
+	}
+	return res, rest, nil
+}
+
+// bodyPos is where the body of a record lies: the stored bytes start at
+// offset from the start of the record. The flate stream of a compressed
+// body starts after the raw size.
+type bodyPos struct {
+	offset uint64
+	stored uint64
+	size   uint64
+}
+
+// parseHead decodes a prefix of the record read from a chunk of version up
+// to its body. It fails with errCorruptRecord if the prefix is too short.
+func parseHead(buf []byte, version int) (record, bodyPos, error) {
+	var rec record
+	var rest []byte
+	// where rest ends in buf
+	end := len(buf)
+	if version == chunkV1 {
+		var ok bool
+		if rec.url, rest, ok = readLenval(buf); !ok {
+			return record{}, bodyPos{}, errCorruptRecord
+		}
+	} else {
+		l, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return record{}, bodyPos{}, errCorruptRecord
+		}
+		payload := buf[n:]
+		if uint64(len(payload)) > l {
+			payload = payload[:l]
+		}
+		end = n + len(payload)
+
+		var err error
+		if rec, rest, err = decodeHead(payload); err != nil {
+			return record{}, bodyPos{}, err
+		}
+	}
+
+	l, n := binary.Uvarint(rest)
+	if n <= 0 {
+		return record{}, bodyPos{}, errCorruptRecord
+	}
+	pos := bodyPos{
+		offset: uint64(end - len(rest) + n),
+		stored: l,
+		size:   l,
+	}
+
+	if rec.flags&flagCompressed != 0 {
+		raw, m := binary.Uvarint(rest[n:])
+		if m <= 0 || uint64(m) > l {
+			return record{}, bodyPos{}, errCorruptRecord
+		}
+		pos.offset += uint64(m)
+		pos.stored -= uint64(m)
+		pos.size = raw
+	}
+	return rec, pos, nil
+}
+
+// parseRecord decodes the record read whole from a chunk of version.
+func parseRecord(buf []byte, version int) (record, error) {
+	if version == chunkV1 {
+		url, rest, ok := readLenval(buf)
+		if !ok {
+			return record{}, errCorruptRecord
+		}
+
+		body, rest, ok := readLenval(rest)
+		if !ok || len(rest) != 0 {
+			return record{}, errCorruptRecord
+		}
+		return record{url: url, body: body}, nil
+	}
+
+	payload, rest, ok := readLenval(buf)
+	if !ok || len(rest) != 0 {
+		return record{}, errCorruptRecord
+	}
+	return decodeRecord(payload)
+}
+
+type chunkReader struct {
+	file    *util.FileReader
+	version int
+	offset  uint64
+	size    uint64
+}
+
+func openChunk(name string) (*chunkReader, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, errors.NewErr(err)
+	}
+
+	file, err := util.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, len(chunkMagic))
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		file.Close()
+		return nil, errors.NewErr(err)
+	}
+
+	// a prefix of the magic is a v2 chunk torn right after creation
+	if bytes.Equal(buf[:n], chunkMagic[:n]) {
+		return &chunkReader{
+			file:    file,
+			version: chunkV2,
+			offset:  uint64(n),
+			size:    uint64(info.Size()),
+		}, nil
+	}
+
+	if _, err := file.Seek(0, 0); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &chunkReader{
+		file:    file,
+		version: chunkV1,
+		offset:  0,
+		size:    uint64(info.Size()),
+	}, nil
+}
+
+func (self *chunkReader) Close() error {
+	return self.file.Close()
+}
+
+func (self *chunkReader) Seek(offset uint64) error {
+	if _, err := self.file.Seek(int64(offset), 0); err != nil {
+		return err
+	}
+
+	self.offset = offset
+	return nil
+}
+
+// Next reads the record at the current offset and returns its offset and
+// length. It returns io.EOF at the clean end of the chunk, errTornRecord if
+// the chunk ends in the middle of a record and errCorruptRecord if the
+// record is complete but broken, in which case reading can go on.
+func (self *chunkReader) Next() (uint64, uint64, record, error) {
+	offset := self.offset
+	if self.version == chunkV1 {
+		n1, url, err := self.file.ReadLenval()
+		if err == io.EOF && n1 == 0 {
+			return offset, 0, record{}, io.EOF
+		}
+		if err != nil {
+			return offset, 0, record{}, errTornRecord
+		}
+
+		n2, body, err := self.file.ReadLenval()
+		if err != nil {
+			return offset, 0, record{}, errTornRecord
+		}
+
+		self.offset += n1 + n2
+		return offset, n1 + n2, record{url: url, body: body}, nil
+	}
+
+	n, payload, err := self.file.ReadLenvalMax(self.size - offset)
+	if err == io.EOF && n == 0 {
+		return offset, 0, record{}, io.EOF
+	}
+	if err != nil {
+		return offset, 0, record{}, errTornRecord
+	}
+
+	self.offset += n
+	rec, err := decodeRecord(payload)
+	return offset, n, rec, err
+}
+
+// compressBody sets the compressed body to rec if it makes rec smaller.
+func compressBody(rec *record) error {
+	if len(rec.body) < minCompressSize {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	buf.Write(binary.AppendUvarint(nil, uint64(len(rec.body))))
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return errors.NewErr(err)
+	}
+	if _, err := w.Write(rec.body); err != nil {
+		return errors.NewErr(err)
+	}
+	if err := w.Close(); err != nil {
+		return errors.NewErr(err)
+	}
+
+	if buf.Len() < len(rec.body) {
+		rec.flags |= flagCompressed
+		rec.body = buf.Bytes()
+	}
+	return nil
+}
+
+// rawBody returns the body of rec as it was written.
+func rawBody(rec record) ([]byte, error) {
+	if rec.flags&flagCompressed == 0 {
+		return rec.body, nil
+	}
+
+	l, n := binary.Uvarint(rec.body)
+	if n <= 0 {
+		return nil, errCorruptRecord
+	}
+
+	res := make([]byte, l)
+	r := flate.NewReader(bytes.NewReader(rec.body[n:]))
+	defer r.Close()
+	if _, err := io.ReadFull(r, res); err != nil {
+		return nil, errors.NewErr(err)
+	}
+	return res, nil
+}
+
+// bodySize returns the raw and the stored length of the body of rec.
+func bodySize(rec record) (uint64, uint64) {
+	if rec.flags&flagCompressed == 0 {
+		return uint64(len(rec.body)), uint64(len(rec.body))
+	}
+
+	l, _ := binary.Uvarint(rec.body)
+	return l, uint64(len(rec.body))
+}
+
+func (self *gkFile) WriteHeader() error {
+	if _, err := self.file.Write(chunkMagic); err != nil {
+		return errors.NewErr(err)
+	}
+
+	self.offset = uint64(len(chunkMagic))
+	return nil
+}
+
+func truncateChunk(name string, size uint64) error {
+	return errors.NewErr(os.Truncate(name, int64(size)))
+}
@@ -0,0 +1,280 @@
+package gatekeeper
+
+import (
+	"io/ioutil"
+	"os"
+	"psearch/util/errors"
+	"psearch/util/log"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const tmpSuffix = ".tmp"
+
+// SetMaster turns the gatekeeper into a read-only replica of addr, or into
+// a master if addr is empty. A master that becomes a replica loses its
+// unsealed chunk, since the new master never saw it.
+func (self *Gatekeeper) SetMaster(addr string) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.master == addr {
+		return nil
+	}
+
+	log.Printf("Gatekeeper.SetMaster(%v)\n", addr)
+	self.master = addr
+	if addr == "" || self.file.file == nil {
+		return nil
+	}
+
+	if err := self.file.Close(); err != nil {
+		return err
+	}
+	self.file = gkFile{}
+
+	if err := os.Remove(self.chunkName(self.fNum)); err != nil {
+		return errors.NewErr(err)
+	}
+	self.readers.drop(self.fNum)
+
+	// the snapshot might cover the removed chunk
+	if err := self.dropSnapshot(); err != nil {
+		return err
+	}
+
+	self.resetIndex()
+	return self.loadDir()
+}
+
+// SkipChunks makes sure the next chunk created has a number of at least num,
+// so a promoted replica doesn't reuse the numbers of the old master.
+func (self *Gatekeeper) SkipChunks(num uint) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.file.file == nil && self.fNum < num {
+		self.fNum = num
+	}
+}
+
+func (self *Gatekeeper) ChunkNum() uint {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	return self.fNum
+}
+
+func (self *Gatekeeper) SetReplicas(addrs []string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.replicas = addrs
+}
+
+func (self *Gatekeeper) isSealed(num uint) bool {
+	_, ok := self.chunks[num]
+	return ok && (self.file.file == nil || num != self.fNum)
+}
+
+func (self *Gatekeeper) removeDeadChunks() error {
+	for k, v := range self.chunks {
+		if v.live == 0 && self.isSealed(k) {
+			if err := self.removeChunk(k); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func chunkInfo(num uint, c *chunkT) ChunkInfo {
+	return ChunkInfo{
+		FNum:      num,
+		Size:      c.size,
+		Live:      c.live,
+		Dead:      c.size - c.live,
+		Corrupted: c.corrupted,
+	}
+}
+
+func (self *Gatekeeper) Chunks() []ChunkInfo {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	res := make([]ChunkInfo, 0, len(self.chunks))
+	for k, v := range self.chunks {
+		if !self.isSealed(k) {
+			continue
+		}
+
+		res = append(res, chunkInfo(k, v))
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].FNum < res[j].FNum
+	})
+	return res
+}
+
+func (self *Gatekeeper) ReadChunk(num uint) ([]byte, error) {
+	self.mutex.RLock()
+	sealed := self.isSealed(num)
+	self.mutex.RUnlock()
+	if !sealed {
+		return nil, errors.New("Chunk " + strconv.Itoa(int(num)) + " is not sealed!")
+	}
+
+	data, err := ioutil.ReadFile(self.chunkName(num))
+	if err != nil {
+		return nil, errors.NewErr(err)
+	}
+
+	return data, nil
+}
+
+// AddChunk stores a sealed chunk received from the master and replays it
+// into the trie.
+func (self *Gatekeeper) AddChunk(num uint, data []byte) error {
+	log.Printf("Gatekeeper.AddChunk(%v, %v)\n", num, len(data))
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.master == "" {
+		return errors.New("Gatekeeper is not a replica!")
+	}
+
+	if _, ok := self.chunks[num]; ok {
+		return nil
+	}
+
+	name := self.chunkName(num)
+	if err := ioutil.WriteFile(name+tmpSuffix, data, 0644); err != nil {
+		return errors.NewErr(err)
+	}
+
+	if err := os.Rename(name+tmpSuffix, name); err != nil {
+		return errors.NewErr(err)
+	}
+
+	if err := self.load(name, num, false, 0); err != nil {
+		return err
+	}
+
+	if num >= self.fNum {
+		self.fNum = num + 1
+	}
+	self.notify()
+
+	if err := self.removeDeadChunks(); err != nil {
+		return err
+	}
+
+	log.Printf("Gatekeeper.AddChunk(%v, %v) OK\n", num, len(data))
+	return nil
+}
+
+func (self *Gatekeeper) pushChunk(num uint, replicas []string) {
+	data, err := ioutil.ReadFile(self.chunkName(num))
+	if err != nil {
+		log.Errorln(errors.NewErr(err))
+		return
+	}
+
+	for _, addr := range replicas {
+		client, err := NewGatekeeperClient(addr)
+		if err != nil {
+			log.Errorln(err)
+			continue
+		}
+
+		if err := client.PushChunk(num, data); err != nil {
+			log.Errorln(err)
+		}
+		client.Close()
+	}
+}
+
+// SyncMaster fetches every sealed chunk of the master that this replica misses.
+func (self *Gatekeeper) SyncMaster() error {
+	self.mutex.RLock()
+	master := self.master
+	self.mutex.RUnlock()
+	if master == "" {
+		return nil
+	}
+
+	client, err := NewGatekeeperClient(master)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	chunks, err := client.Chunks()
+	if err != nil {
+		return err
+	}
+
+	for _, c := range chunks {
+		self.mutex.RLock()
+		_, ok := self.chunks[c.FNum]
+		self.mutex.RUnlock()
+		if ok || c.Live == 0 {
+			continue
+		}
+
+		data, err := client.ReadChunk(c.FNum)
+		if err != nil {
+			return err
+		}
+
+		if err := self.AddChunk(c.FNum, data); err != nil {
+			return err
+		}
+	}
+
+	// we have every chunk the master has, so pruning is as safe as there
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if err := self.pruneTombstones(); err != nil {
+		return err
+	}
+	self.pruneBlobs()
+	return self.removeDeadChunks()
+}
+
+func (self *Gatekeeper) RunReplica(interval time.Duration) error {
+	log.Printf("Gatekeeper.RunReplica()\n")
+	for {
+		if err := self.SyncMaster(); err != nil {
+			return err
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (self *GatekeeperServer) Chunks(args *struct{}, result *[]ChunkInfo) error {
+	*result = self.Gatekeeper.Chunks()
+	return nil
+}
+
+func (self *GatekeeperServer) ReadChunk(args *ChunkArgs, result *ChunkData) error {
+	data, err := self.Gatekeeper.ReadChunk(args.FNum)
+	if err != nil {
+		log.Errorln(err, args.FNum)
+		return err
+	}
+
+	*result = ChunkData{
+		FNum: args.FNum,
+		Data: data,
+	}
+	return nil
+}
+
+func (self *GatekeeperServer) PushChunk(args *ChunkData, result *struct{}) error {
+	if err := self.Gatekeeper.AddChunk(args.FNum, args.Data); err != nil {
+		log.Errorln(err, args.FNum)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package gatekeeper
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net/url"
+	"psearch/util/errors"
+	"sort"
+	"strconv"
+)
+
+// points per place, enough for an even split of a dozen places
+const ringPoints = 128
+
+// Ring maps hosts to n places, the nodes of the front or the shards of the
+// client, with consistent hashing. The points of a place depend only on its
+// number, so appending a place moves only the hosts it takes over. All urls
+// of a host live in one place.
+type Ring struct {
+	points []uint32
+	owners []int
+}
+
+// fnv of similar strings like the ring points is far from uniform
+func ringHash(s string) uint32 {
+	h := sha1.Sum([]byte(s))
+	return binary.BigEndian.Uint32(h[:4])
+}
+
+func NewRing(n int) *Ring {
+	type point struct {
+		hash  uint32
+		owner int
+	}
+	arr := make([]point, 0, n*ringPoints)
+	for k := 0; k < n; k++ {
+		for i := 0; i < ringPoints; i++ {
+			arr = append(arr, point{ringHash(strconv.Itoa(k) + "#" + strconv.Itoa(i)), k})
+		}
+	}
+	sort.Slice(arr, func(i, j int) bool {
+		return arr[i].hash < arr[j].hash
+	})
+
+	self := &Ring{}
+	for _, p := range arr {
+		self.points = append(self.points, p.hash)
+		self.owners = append(self.owners, p.owner)
+	}
+	return self
+}
+
+// PlaceOf returns the number of the place of the url by its host.
+func (self *Ring) PlaceOf(u string) (int, error) {
+	if len(self.points) == 0 {
+		return 0, errors.New("No places!")
+	}
+
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return 0, errors.NewErr(err)
+	}
+
+	h := ringHash(parsed.Host)
+	i := sort.Search(len(self.points), func(i int) bool {
+		return self.points[i] >= h
+	})
+	if i == len(self.points) {
+		i = 0
+	}
+	return self.owners[i], nil
+}
@@ -0,0 +1,46 @@
+package gatekeeper
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestRing checks that the hosts are split evenly, the urls of a host stay
+// together and an appended place takes hosts only from the others.
+func TestRing(t *testing.T) {
+	const hosts = 10000
+	four, five := NewRing(4), NewRing(5)
+	cnt := make([]int, 5)
+	moved := 0
+	for i := 0; i < hosts; i++ {
+		a, err := four.PlaceOf(fmt.Sprintf("http://h%d.ru/", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := four.PlaceOf(fmt.Sprintf("http://h%d.ru/some/page?a=1", i)); b != a {
+			t.Fatal("Host is split", i, a, b)
+		}
+
+		b, _ := five.PlaceOf(fmt.Sprintf("http://h%d.ru/", i))
+		if b != a {
+			if b != 4 {
+				t.Fatal("Moved between old places", i, a, b)
+			}
+			moved += 1
+		}
+		cnt[a] += 1
+	}
+
+	for i, c := range cnt[:4] {
+		if c < hosts/4*2/3 || c > hosts/4*4/3 {
+			t.Fatal("Uneven", i, cnt)
+		}
+	}
+	if moved < hosts/5*2/3 || moved > hosts/5*4/3 {
+		t.Fatal("Moved", moved)
+	}
+
+	if _, err := NewRing(0).PlaceOf("http://a.ru/"); err == nil {
+		t.Fatal("Placed on no places")
+	}
+}
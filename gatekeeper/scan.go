@@ -0,0 +1,65 @@
+package gatekeeper
+
+import (
+	"psearch/util/log"
+	"time"
+)
+
+// MaxScanLimit bounds a single Scan page, so a careless client can't make us
+// copy the whole trie.
+const MaxScanLimit = 1000
+
+// Scan returns up to limit keys starting with prefix and greater than
+// startAfter in key order, and the startAfter of the next page, which is empty
+// on the last one. Keys are urls after UrlTransform, so a prefix like
+// "http://ru.habrahabr." selects all subdomains of a host.
+func (self *Gatekeeper) Scan(prefix, startAfter string, limit int) ([]ScanItem, string) {
+	log.Printf("Gatekeeper.Scan(%v, %v, %v)\n", prefix, startAfter, limit)
+	if limit <= 0 || limit > MaxScanLimit {
+		limit = MaxScanLimit
+	}
+
+	res := []ScanItem{}
+	now := time.Now().Unix()
+	self.mutex.RLock()
+	// one more to know if there is a next page
+	self.trie.WalkAfter([]byte(prefix), []byte(startAfter), func(key []byte, e *entryT) bool {
+		if expired(e, now) {
+			return true
+		}
+		res = append(res, ScanItem{
+			Key: string(key),
+			Val: e.versions[0].val,
+		})
+		return len(res) <= limit
+	})
+	self.mutex.RUnlock()
+
+	next := ""
+	if len(res) > limit {
+		res = res[:limit]
+		next = res[limit-1].Key
+	}
+
+	log.Printf("Gatekeeper.Scan(%v, %v, %v) OK (%v keys)\n", prefix, startAfter, limit, len(res))
+	return res, next
+}
+
+func (self *GatekeeperServer) Scan(args *ScanArgs, result *ScanResult) error {
+	items, next := self.Gatekeeper.Scan(args.Prefix, args.StartAfter, args.Limit)
+	for i := range items {
+		// the transform reverses the host back
+		u, err := UrlTransform(items[i].Key)
+		if err != nil {
+			log.Errorln(err, args)
+			return err
+		}
+		items[i].Url = u
+	}
+
+	*result = ScanResult{
+		Items: items,
+		Next:  next,
+	}
+	return nil
+}
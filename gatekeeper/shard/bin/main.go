@@ -0,0 +1,28 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"psearch/gatekeeper/shard"
+	"psearch/util/log"
+	"strings"
+)
+
+func main() {
+	var help = flag.Bool("help", false, "print help")
+	var from = flag.String("from", "", "comma separated gatekeeper addresses of the current shard map")
+	var to = flag.String("to", "", "comma separated gatekeeper addresses of the new shard map")
+	flag.Parse()
+
+	if *help || *from == "" || *to == "" {
+		flag.PrintDefaults()
+		return
+	}
+
+	cnt, err := shard.Migrate(strings.Split(*from, ","), strings.Split(*to, ","))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "%v urls moved\n", cnt)
+}
@@ -0,0 +1,412 @@
+package shard
+
+import (
+	"psearch/gatekeeper"
+	"psearch/util/errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Client talks to many gatekeepers as to one, routing every url to the shard
+// of its host. While keys are migrated to a new shard map, the old map is
+// kept: writes go to the new shards, and reads of urls missing there fall
+// back to the old ones.
+type Client struct {
+	ring    *Ring
+	old     *Ring
+	mutex   sync.Mutex
+	clients gatekeeper.GatekeeperClients
+}
+
+// NewClient makes a client for the shards, old is the previous shard map if
+// a migration is in progress, or nil. Connections are made on first use.
+func NewClient(shards, old []string) *Client {
+	self := &Client{}
+	self.SetShards(shards, old)
+	return self
+}
+
+// SetShards changes the shard map, see NewClient.
+func (self *Client) SetShards(shards, old []string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	self.ring = NewRing(shards)
+	self.old = nil
+	if old != nil {
+		self.old = NewRing(old)
+	}
+}
+
+func (self *Client) rings() (*Ring, *Ring) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.ring, self.old
+}
+
+func (self *Client) call(addr, method string, args, result interface{}) error {
+	return self.clients.Call(addr, method, args, result)
+}
+
+func (self *Client) Close() {
+	self.clients.Close()
+}
+
+// owners returns the shard of u and its old shard if it is another one.
+func (self *Client) owners(u string) (string, string, error) {
+	ring, old := self.rings()
+	addr, err := ring.ShardOf(u)
+	if err != nil {
+		return "", "", err
+	}
+
+	if old == nil {
+		return addr, "", nil
+	}
+	prev, err := old.ShardOf(u)
+	if err != nil || prev == addr {
+		return addr, "", nil
+	}
+	return addr, prev, nil
+}
+
+// read calls method for u on its shard, and on the old one if found says
+// the url is not there.
+func (self *Client) read(u, method string, args, result interface{}, found func() bool) error {
+	addr, prev, err := self.owners(u)
+	if err != nil {
+		return err
+	}
+
+	if err := self.call(addr, method, args, result); err != nil {
+		return err
+	}
+	if found() || prev == "" {
+		return nil
+	}
+	return self.call(prev, method, args, result)
+}
+
+func (self *Client) Find(u string) (gatekeeper.Value, bool, error) {
+	var res gatekeeper.FindResult
+	err := self.read(u, "Find", gatekeeper.FindArgs{Url: u}, &res, func() bool {
+		return res.Val != nil
+	})
+	if err != nil || res.Val == nil {
+		return gatekeeper.Value{}, false, err
+	}
+	return *res.Val, true, nil
+}
+
+func (self *Client) Read(u string) (gatekeeper.Value, bool, string, error) {
+	var res gatekeeper.ReadResult
+	err := self.read(u, "Read", gatekeeper.FindArgs{Url: u}, &res, func() bool {
+		return res.Val != nil
+	})
+	if err != nil || res.Val == nil || res.Body == nil {
+		return gatekeeper.Value{}, false, "", err
+	}
+	return *res.Val, true, *res.Body, nil
+}
+
+func (self *Client) ReadMeta(u string) (gatekeeper.Value, bool, *gatekeeper.Meta, error) {
+	var res gatekeeper.ReadMetaResult
+	err := self.read(u, "ReadMeta", gatekeeper.FindArgs{Url: u}, &res, func() bool {
+		return res.Val != nil
+	})
+	if err != nil || res.Val == nil {
+		return gatekeeper.Value{}, false, nil, err
+	}
+	return *res.Val, true, res.Meta, nil
+}
+
+func (self *Client) write(args gatekeeper.WriteArgs) (gatekeeper.Value, error) {
+	addr, _, err := self.owners(args.Url)
+	if err != nil {
+		return gatekeeper.Value{}, err
+	}
+
+	var res gatekeeper.FindResult
+	if err := self.call(addr, "Write", args, &res); err != nil {
+		return gatekeeper.Value{}, err
+	}
+	if res.Val == nil {
+		return gatekeeper.Value{}, errors.New("Shard " + addr + " returned no value!")
+	}
+	return *res.Val, nil
+}
+
+func (self *Client) Write(u string, body string) (gatekeeper.Value, error) {
+	return self.write(gatekeeper.WriteArgs{FindArgs: gatekeeper.FindArgs{Url: u}, Body: body})
+}
+
+func (self *Client) WriteWithMeta(u string, body string, meta gatekeeper.Meta) (gatekeeper.Value, error) {
+	return self.write(gatekeeper.WriteArgs{FindArgs: gatekeeper.FindArgs{Url: u}, Body: body, Meta: &meta})
+}
+
+func (self *Client) WriteTTL(u string, body string, ttl time.Duration) (gatekeeper.Value, error) {
+	return self.write(gatekeeper.WriteArgs{FindArgs: gatekeeper.FindArgs{Url: u}, Body: body, TTL: int(ttl / time.Second)})
+}
+
+// Delete deletes u on the old shard too, so the fallback doesn't bring it
+// back.
+func (self *Client) Delete(u string) (bool, error) {
+	addr, prev, err := self.owners(u)
+	if err != nil {
+		return false, err
+	}
+
+	var res gatekeeper.DeleteResult
+	if err := self.call(addr, "Delete", gatekeeper.FindArgs{Url: u}, &res); err != nil {
+		return false, err
+	}
+	if prev == "" {
+		return res.Deleted, nil
+	}
+
+	var old gatekeeper.DeleteResult
+	if err := self.call(prev, "Delete", gatekeeper.FindArgs{Url: u}, &old); err != nil {
+		return false, err
+	}
+	return res.Deleted || old.Deleted, nil
+}
+
+func pick(urls []string, idx []int) []string {
+	res := make([]string, len(idx))
+	for j, i := range idx {
+		res[j] = urls[i]
+	}
+	return res
+}
+
+// shardError tells which shard failed.
+func shardError(addr string, err error) error {
+	return errors.New("Shard " + addr + ": " + err.Error())
+}
+
+// reply checks that a shard answered for each of n urls.
+func reply(addr string, n, m int) error {
+	if n != m {
+		return errors.New("Shard " + addr + " returned " + strconv.Itoa(m) + " results for " + strconv.Itoa(n) + " urls!")
+	}
+	return nil
+}
+
+// each calls fn with the urls of every shard, and then with the urls retry
+// tells to look up on their old shards. The urls that can't be routed or
+// whose shard fails get an error and are not retried.
+func (self *Client) each(urls []string, fn func(addr string, idx []int) error, retry func(i int) bool) []error {
+	errs := make([]error, len(urls))
+	groups := map[string][]int{}
+	prevs := make([]string, len(urls))
+	for i, u := range urls {
+		addr, prev, err := self.owners(u)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		groups[addr] = append(groups[addr], i)
+		prevs[i] = prev
+	}
+
+	call := func(groups map[string][]int) {
+		for addr, idx := range groups {
+			if err := fn(addr, idx); err != nil {
+				for _, i := range idx {
+					errs[i] = shardError(addr, err)
+				}
+			}
+		}
+	}
+	call(groups)
+
+	if retry == nil {
+		return errs
+	}
+	groups = map[string][]int{}
+	for i, prev := range prevs {
+		if prev != "" && errs[i] == nil && retry(i) {
+			groups[prev] = append(groups[prev], i)
+		}
+	}
+	call(groups)
+	return errs
+}
+
+func (self *Client) FindAll(urls []string) ([]gatekeeper.FindAllResult, error) {
+	res := make([]gatekeeper.FindAllResult, len(urls))
+	errs := self.each(urls, func(addr string, idx []int) error {
+		var r []gatekeeper.FindAllResult
+		if err := self.call(addr, "FindAll", gatekeeper.FindAllArgs{Urls: pick(urls, idx)}, &r); err != nil {
+			return err
+		}
+		if err := reply(addr, len(idx), len(r)); err != nil {
+			return err
+		}
+		for j, i := range idx {
+			res[i] = r[j]
+		}
+		return nil
+	}, func(i int) bool {
+		return res[i].Val == nil && res[i].Error == ""
+	})
+
+	for i, err := range errs {
+		if err != nil {
+			res[i] = gatekeeper.FindAllResult{Error: err.Error()}
+		}
+	}
+	return res, nil
+}
+
+func (self *Client) ReadAll(urls []string) ([]gatekeeper.ReadAllResult, error) {
+	res := make([]gatekeeper.ReadAllResult, len(urls))
+	errs := self.each(urls, func(addr string, idx []int) error {
+		var r []gatekeeper.ReadAllResult
+		if err := self.call(addr, "ReadAll", gatekeeper.FindAllArgs{Urls: pick(urls, idx)}, &r); err != nil {
+			return err
+		}
+		if err := reply(addr, len(idx), len(r)); err != nil {
+			return err
+		}
+		for j, i := range idx {
+			res[i] = r[j]
+		}
+		return nil
+	}, func(i int) bool {
+		return res[i].Val == nil && res[i].Error == ""
+	})
+
+	for i, err := range errs {
+		if err != nil {
+			res[i] = gatekeeper.ReadAllResult{Error: err.Error()}
+		}
+	}
+	return res, nil
+}
+
+func (self *Client) WriteAll(docs []gatekeeper.WriteArgs) ([]gatekeeper.FindAllResult, error) {
+	urls := make([]string, len(docs))
+	for i, d := range docs {
+		urls[i] = d.Url
+	}
+
+	res := make([]gatekeeper.FindAllResult, len(docs))
+	errs := self.each(urls, func(addr string, idx []int) error {
+		args := gatekeeper.WriteAllArgs{
+			Docs: make([]gatekeeper.WriteArgs, len(idx)),
+		}
+		for j, i := range idx {
+			args.Docs[j] = docs[i]
+		}
+
+		var r []gatekeeper.FindAllResult
+		if err := self.call(addr, "WriteAll", args, &r); err != nil {
+			return err
+		}
+		if err := reply(addr, len(idx), len(r)); err != nil {
+			return err
+		}
+		for j, i := range idx {
+			res[i] = r[j]
+		}
+		return nil
+	}, nil)
+
+	for i, err := range errs {
+		if err != nil {
+			res[i] = gatekeeper.FindAllResult{Error: err.Error()}
+		}
+	}
+	return res, nil
+}
+
+// MightContain is false only for the urls definitely not on their shard nor
+// on the old one. It fails if a shard fails, as the single gatekeeper does.
+func (self *Client) MightContain(urls []string) ([]bool, error) {
+	res := make([]bool, len(urls))
+	errs := self.each(urls, func(addr string, idx []int) error {
+		var r []bool
+		if err := self.call(addr, "MightContain", gatekeeper.FindAllArgs{Urls: pick(urls, idx)}, &r); err != nil {
+			return err
+		}
+		if err := reply(addr, len(idx), len(r)); err != nil {
+			return err
+		}
+		for j, i := range idx {
+			res[i] = r[j]
+		}
+		return nil
+	}, func(i int) bool {
+		return !res[i]
+	})
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// Scan merges the pages of all shards, the new ones first, so a key copied
+// but not yet deleted by a migration comes once.
+func (self *Client) Scan(prefix, startAfter string, limit int) ([]gatekeeper.ScanItem, string, error) {
+	if limit <= 0 || limit > gatekeeper.MaxScanLimit {
+		limit = gatekeeper.MaxScanLimit
+	}
+
+	ring, old := self.rings()
+	addrs := append([]string{}, ring.Shards()...)
+	if old != nil {
+		for _, s := range old.Shards() {
+			if !hasShard(addrs, s) {
+				addrs = append(addrs, s)
+			}
+		}
+	}
+
+	more := false
+	items := []gatekeeper.ScanItem{}
+	for _, addr := range addrs {
+		var r gatekeeper.ScanResult
+		args := gatekeeper.ScanArgs{Prefix: prefix, StartAfter: startAfter, Limit: limit}
+		if err := self.call(addr, "Scan", args, &r); err != nil {
+			return nil, "", shardError(addr, err)
+		}
+
+		items = append(items, r.Items...)
+		more = more || r.Next != ""
+	}
+
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].Key < items[j].Key
+	})
+	res := items[:0]
+	for _, it := range items {
+		if len(res) == 0 || res[len(res)-1].Key != it.Key {
+			res = append(res, it)
+		}
+	}
+
+	if len(res) > limit {
+		res = res[:limit]
+		more = true
+	}
+	next := ""
+	if more && len(res) != 0 {
+		next = res[len(res)-1].Key
+	}
+	return res, next, nil
+}
+
+func hasShard(arr []string, s string) bool {
+	for _, x := range arr {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
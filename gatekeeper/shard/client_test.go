@@ -0,0 +1,130 @@
+package shard
+
+import (
+	"fmt"
+	"io/ioutil"
+	stdlog "log"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"psearch/gatekeeper"
+	"psearch/util/log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.Logger = stdlog.New(ioutil.Discard, "", 0)
+	os.Exit(m.Run())
+}
+
+// serveShard serves a new gatekeeper over json-rpc.
+func serveShard(t *testing.T) (string, *gatekeeper.Gatekeeper) {
+	gk, err := gatekeeper.NewGatekeeper(t.TempDir(), 1<<20, time.Minute, 3, 1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := rpc.NewServer()
+	if err := srv.Register(&gatekeeper.GatekeeperServer{Gatekeeper: gk}); err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		l.Close()
+		gk.Close()
+	})
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go srv.ServeCodec(jsonrpc.NewServerCodec(c))
+		}
+	}()
+	return l.Addr().String(), gk
+}
+
+// deadShard returns an address nobody listens on.
+func deadShard(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+// TestShardErrors checks that the urls of a shard that is down get its
+// error, and the others are served.
+func TestShardErrors(t *testing.T) {
+	live, _ := serveShard(t)
+	dead := deadShard(t)
+	c := NewClient([]string{live, dead}, nil)
+	defer c.Close()
+	ring := NewRing([]string{live, dead})
+
+	urls := []string{}
+	docs := []gatekeeper.WriteArgs{}
+	for i := 0; i < 20; i++ {
+		u := fmt.Sprintf("http://h%d.ru/", i)
+		urls = append(urls, u)
+		docs = append(docs, gatekeeper.WriteArgs{FindArgs: gatekeeper.FindArgs{Url: u}, Body: "body"})
+	}
+
+	check := func(method string, errs []string) {
+		for i, u := range urls {
+			addr, _ := ring.ShardOf(u)
+			failed := strings.Contains(errs[i], "Shard "+dead)
+			if failed != (addr == dead) {
+				t.Fatal(method, u, "on", addr, "error", errs[i])
+			}
+		}
+	}
+
+	written, err := c.WriteAll(docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := make([]string, len(urls))
+	for i, r := range written {
+		errs[i] = r.Error
+	}
+	check("WriteAll", errs)
+
+	found, err := c.FindAll(urls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range found {
+		errs[i] = r.Error
+		if r.Error == "" && r.Val == nil {
+			t.Fatal("FindAll lost", urls[i])
+		}
+	}
+	check("FindAll", errs)
+
+	read, err := c.ReadAll(urls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range read {
+		errs[i] = r.Error
+	}
+	check("ReadAll", errs)
+
+	if _, err := c.MightContain(urls); err == nil || !strings.Contains(err.Error(), dead) {
+		t.Fatal("MightContain", err)
+	}
+	if _, _, err := c.Scan("", "", 10); err == nil || !strings.Contains(err.Error(), dead) {
+		t.Fatal("Scan", err)
+	}
+}
@@ -0,0 +1,153 @@
+package shard
+
+import (
+	"psearch/gatekeeper"
+	"psearch/util/errors"
+	"psearch/util/log"
+	"strconv"
+)
+
+// Migrate moves the urls whose shard in the map to differs from the one in
+// from, with all the kept versions, oldest first, and deletes them on the
+// old shard. Clients must already write by the new map, so a url found on
+// its new shard is newer and is not overwritten. It returns the number of
+// urls moved.
+func Migrate(from, to []string) (int, error) {
+	log.Printf("shard.Migrate(%v, %v)\n", from, to)
+	c := NewClient(to, from)
+	defer c.Close()
+
+	cnt := 0
+	for _, addr := range from {
+		n, err := c.migrateShard(addr)
+		cnt += n
+		if err != nil {
+			return cnt, err
+		}
+	}
+
+	log.Printf("shard.Migrate(%v, %v) OK (%v moved)\n", from, to, cnt)
+	return cnt, nil
+}
+
+func (self *Client) migrateShard(addr string) (int, error) {
+	log.Printf("Client.migrateShard(%v)\n", addr)
+	ring, _ := self.rings()
+
+	cnt := 0
+	after := ""
+	for {
+		var r gatekeeper.ScanResult
+		if err := self.call(addr, "Scan", gatekeeper.ScanArgs{StartAfter: after, Limit: gatekeeper.MaxScanLimit}, &r); err != nil {
+			return cnt, err
+		}
+
+		for _, it := range r.Items {
+			dst, err := ring.ShardOf(it.Url)
+			if err != nil {
+				return cnt, err
+			}
+			if dst == addr {
+				continue
+			}
+
+			if err := self.moveUrl(it.Url, addr, dst); err != nil {
+				return cnt, err
+			}
+			cnt += 1
+		}
+
+		if r.Next == "" {
+			break
+		}
+		after = r.Next
+	}
+
+	log.Printf("Client.migrateShard(%v) OK (%v moved)\n", addr, cnt)
+	return cnt, nil
+}
+
+// readVersion reads the n-th version of u on addr window by window, the
+// body goes as bytes, so binary documents are copied intact. It returns
+// false if the version is gone.
+func (self *Client) readVersion(addr, u string, n int) (gatekeeper.ReadRangeResult, bool, error) {
+	args := gatekeeper.ReadRangeArgs{
+		FindArgs: gatekeeper.FindArgs{Url: u},
+		N:        n,
+		Len:      gatekeeper.MaxReadRange,
+	}
+	var res gatekeeper.ReadRangeResult
+	for {
+		var r gatekeeper.ReadRangeResult
+		if err := self.call(addr, "ReadRange", args, &r); err != nil {
+			return res, false, err
+		}
+		if r.Val == nil {
+			return res, false, nil
+		}
+
+		if args.Val == nil {
+			res = r
+			res.Data = make([]byte, 0, r.Size)
+		}
+		res.Data = append(res.Data, r.Data...)
+		if int64(len(res.Data)) >= r.Size || len(r.Data) == 0 {
+			break
+		}
+		// the next windows stay on the same record
+		args.Val = r.Val
+		args.Offset = int64(len(res.Data))
+	}
+
+	if int64(len(res.Data)) != res.Size {
+		return res, false, errors.New("Read " + strconv.Itoa(len(res.Data)) + " bytes of " + u + " instead of " + strconv.FormatInt(res.Size, 10) + "!")
+	}
+	return res, true, nil
+}
+
+// moveUrl copies the versions of u from src to dst, each one written only
+// if the current version on dst is the one copied before, so a newer write
+// to dst is never overwritten, and deletes u on src.
+func (self *Client) moveUrl(u, src, dst string) error {
+	var vals gatekeeper.VersionsResult
+	if err := self.call(src, "ListVersions", gatekeeper.FindArgs{Url: u}, &vals); err != nil {
+		return err
+	}
+
+	prev := gatekeeper.Value{}
+	for n := len(vals.Vals) - 1; n >= 0; n-- {
+		doc, ok, err := self.readVersion(src, u, n)
+		if err != nil {
+			return err
+		}
+		// deleted meanwhile
+		if !ok {
+			return nil
+		}
+
+		args := gatekeeper.WriteArgs{
+			FindArgs:  gatekeeper.FindArgs{Url: u},
+			Data:      doc.Data,
+			Meta:      doc.Meta,
+			Expires:   doc.Expires,
+			IfCurrent: &prev,
+		}
+		if doc.Expires == 0 {
+			// not the default TTL of dst
+			args.TTL = -1
+		}
+
+		var w gatekeeper.FindResult
+		if err := self.call(dst, "Write", args, &w); err != nil {
+			return err
+		}
+		// written to dst meanwhile, that is newer
+		if w.Val == nil {
+			break
+		}
+		prev = *w.Val
+	}
+
+	var d gatekeeper.DeleteResult
+	return self.call(src, "Delete", gatekeeper.FindArgs{Url: u}, &d)
+}
@@ -0,0 +1,83 @@
+package shard
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"psearch/gatekeeper"
+	"testing"
+	"time"
+)
+
+// urlOn returns a url the ring puts on addr.
+func urlOn(t *testing.T, ring *Ring, addr, path string) string {
+	for i := 0; i < 1000; i++ {
+		u := fmt.Sprintf("http://h%d.ru/%s", i, path)
+		if s, _ := ring.ShardOf(u); s == addr {
+			return u
+		}
+	}
+	t.Fatal("No url on", addr)
+	return ""
+}
+
+func writeTTL(t *testing.T, gk *gatekeeper.Gatekeeper, u, body string, ttl time.Duration) {
+	key, _ := gatekeeper.UrlTransform(u)
+	if _, err := gk.WriteTTL(u, key, nil, []byte(body), ttl); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestMigrate moves the versions with their expiry and binary bodies
+// intact, and keeps a newer version written to the new shard.
+func TestMigrate(t *testing.T) {
+	src, srcGk := serveShard(t)
+	dst, dstGk := serveShard(t)
+	ring := NewRing([]string{src, dst})
+
+	moved := urlOn(t, ring, dst, "moved")
+	writeTTL(t, srcGk, moved, "old", -1)
+	writeTTL(t, srcGk, moved, "new", time.Hour)
+
+	newer := urlOn(t, ring, dst, "newer")
+	writeTTL(t, srcGk, newer, "stale", -1)
+	writeTTL(t, dstGk, newer, "fresh", -1)
+
+	// invalid utf-8 over several windows
+	binary := urlOn(t, ring, dst, "binary")
+	data := make([]byte, 2*gatekeeper.MaxReadRange+100)
+	rand.New(rand.NewSource(1)).Read(data)
+	data[0], data[1] = 0xff, 0xfe
+	writeTTL(t, srcGk, binary, string(data), -1)
+
+	if n, err := Migrate([]string{src}, []string{src, dst}); err != nil || n != 3 {
+		t.Fatal("Migrate", n, err)
+	}
+
+	c := NewClient([]string{src, dst}, nil)
+	defer c.Close()
+
+	var vals gatekeeper.VersionsResult
+	if err := c.call(dst, "ListVersions", gatekeeper.FindArgs{Url: moved}, &vals); err != nil || len(vals.Vals) != 2 {
+		t.Fatal("Versions", vals, err)
+	}
+	var doc gatekeeper.ReadResult
+	if err := c.call(dst, "ReadVersion", gatekeeper.VersionArgs{FindArgs: gatekeeper.FindArgs{Url: moved}}, &doc); err != nil || *doc.Body != "new" {
+		t.Fatal("ReadVersion", doc, err)
+	}
+	if left := time.Until(time.Unix(doc.Expires, 0)); left < 59*time.Minute || left > time.Hour {
+		t.Fatal("Expiry is not copied", doc.Expires)
+	}
+	key, _ := gatekeeper.UrlTransform(moved)
+	if _, ok := srcGk.Find(key); ok {
+		t.Fatal("Moved url is left on the old shard")
+	}
+
+	if doc, ok, err := c.readVersion(dst, binary, 0); err != nil || !ok || !bytes.Equal(doc.Data, data) {
+		t.Fatal("Binary body is not copied intact", ok, err)
+	}
+
+	if _, ok, body, err := c.Read(newer); !ok || body != "fresh" || err != nil {
+		t.Fatal("Newer version is overwritten", body, err)
+	}
+}
@@ -0,0 +1,38 @@
+package shard
+
+import (
+	"psearch/gatekeeper"
+	"psearch/util/errors"
+)
+
+// Ring maps urls to shards with gatekeeper.Ring, as the front maps them to
+// its nodes: shard i of the list gets the hosts of node i. New shards go to
+// the end of the list, then only the hosts they take over move.
+type Ring struct {
+	shards []string
+	ring   *gatekeeper.Ring
+}
+
+func NewRing(shards []string) *Ring {
+	return &Ring{
+		shards: shards,
+		ring:   gatekeeper.NewRing(len(shards)),
+	}
+}
+
+func (self *Ring) Shards() []string {
+	return self.shards
+}
+
+// ShardOf returns the shard of the url.
+func (self *Ring) ShardOf(u string) (string, error) {
+	if len(self.shards) == 0 {
+		return "", errors.New("No shards!")
+	}
+
+	i, err := self.ring.PlaceOf(u)
+	if err != nil {
+		return "", err
+	}
+	return self.shards[i], nil
+}
@@ -0,0 +1,438 @@
+package gatekeeper
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"psearch/util/errors"
+	"psearch/util/log"
+	"time"
+)
+
+// The snapshot is the trie and the chunk table as of some position in the
+// chunk log:
+//
+//	magic uvarint(fnum) uvarint(offset)
+//	uvarint(chunks) {uvarint(num) uvarint(version) uvarint(size) uvarint(corrupted) uvarint(raw) uvarint(stored)}...
+//	{3 lenval(hash) uvarint(fnum) uvarint(offset) uvarint(len)}...
+//	{1 lenval(key) uvarint(versions) {uvarint(fnum) uvarint(offset) uvarint(len) uvarint(pos fnum) uvarint(pos offset) lenval(ref) uvarint(expires)}...}...
+//	{2 lenval(key) uvarint(fnum) uvarint(offset) uvarint(len) uvarint(origin)}... 0
+//	crc32
+//
+// Everything written before (fnum, offset) is in the snapshot, the rest is
+// replayed from the chunks at startup. Live bytes are counted again from
+// the records held.
+const snapshotName = "index"
+
+var snapshotMagic = []byte("gkidx\x05")
+
+// snapshotT is the position of the snapshot in the directory, if there is
+// one. Removing it changes gen, so a snapshot being written meanwhile is
+// thrown away instead of renamed into place.
+type snapshotT struct {
+	pos Value
+	ok  bool
+	gen uint
+}
+
+// dropSnapshot removes the snapshot, the next start replays all chunks.
+func (self *Gatekeeper) dropSnapshot() error {
+	self.snapshot.gen += 1
+	self.snapshot.ok = false
+	self.snapshot.pos = Value{}
+	if err := os.Remove(self.dir + "/" + snapshotName); err != nil && !os.IsNotExist(err) {
+		return errors.NewErr(err)
+	}
+	return nil
+}
+
+type snapshotWriter struct {
+	w   *bufio.Writer
+	buf []byte
+}
+
+func (self *snapshotWriter) Uvarint(v uint64) error {
+	self.buf = binary.AppendUvarint(self.buf[:0], v)
+	_, err := self.w.Write(self.buf)
+	return err
+}
+
+func (self *snapshotWriter) Bytes(b []byte) error {
+	if err := self.Uvarint(uint64(len(b))); err != nil {
+		return err
+	}
+
+	_, err := self.w.Write(b)
+	return err
+}
+
+// snapshotState is a copy of what the snapshot holds, so it is encoded and
+// fsynced without the lock.
+type snapshotState struct {
+	// the position the snapshot is written at
+	pos        Value
+	chunks     map[uint]chunkT
+	blobs      map[string]Value
+	entries    []snapshotEntry
+	tombstones map[string]tombstoneT
+}
+
+type snapshotEntry struct {
+	key      string
+	versions []versionT
+}
+
+// snapshotState copies the index, the caller holds the lock.
+func (self *Gatekeeper) snapshotState() snapshotState {
+	res := snapshotState{
+		pos:        Value{FNum: self.fNum},
+		chunks:     make(map[uint]chunkT, len(self.chunks)),
+		blobs:      make(map[string]Value, len(self.blobs)),
+		entries:    make([]snapshotEntry, 0, self.trie.Keys),
+		tombstones: make(map[string]tombstoneT, len(self.tombstones)),
+	}
+	if self.file.file != nil {
+		res.pos.Offset = self.file.offset
+	}
+
+	for num, c := range self.chunks {
+		res.chunks[num] = *c
+	}
+	for hash, b := range self.blobs {
+		if b.val.Len != 0 {
+			res.blobs[hash] = b.val
+		}
+	}
+	// the versions are changed in place by the writers
+	self.trie.Walk(nil, func(key []byte, e *entryT) bool {
+		res.entries = append(res.entries, snapshotEntry{string(key), append([]versionT{}, e.versions...)})
+		return true
+	})
+	for key, t := range self.tombstones {
+		res.tombstones[key] = t
+	}
+	return res
+}
+
+func (self *Gatekeeper) WriteSnapshot() error {
+	log.Printf("Gatekeeper.WriteSnapshot()\n")
+	// writers wait only for the copy
+	self.mutex.RLock()
+	st := self.snapshotState()
+	gen := self.snapshot.gen
+	self.mutex.RUnlock()
+
+	// the snapshot must not point to data that can still be lost
+	if err := self.syncFile(); err != nil {
+		return err
+	}
+
+	name := self.dir + "/" + snapshotName
+	f, err := os.Create(name + tmpSuffix)
+	if err != nil {
+		return errors.NewErr(err)
+	}
+	defer f.Close()
+
+	crc := crc32.NewIEEE()
+	sw := snapshotWriter{
+		w: bufio.NewWriter(io.MultiWriter(f, crc)),
+	}
+	if err := writeSnapshot(&sw, st); err != nil {
+		return errors.NewErr(err)
+	}
+
+	if err := sw.w.Flush(); err != nil {
+		return errors.NewErr(err)
+	}
+
+	if _, err := f.Write(binary.LittleEndian.AppendUint32(nil, crc.Sum32())); err != nil {
+		return errors.NewErr(err)
+	}
+
+	if err := f.Sync(); err != nil {
+		return errors.NewErr(err)
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.snapshot.gen != gen {
+		log.Printf("Gatekeeper.WriteSnapshot() OK (outdated by the merger)\n")
+		return errors.NewErr(os.Remove(name + tmpSuffix))
+	}
+
+	if err := os.Rename(name+tmpSuffix, name); err != nil {
+		return errors.NewErr(err)
+	}
+	self.snapshot.pos, self.snapshot.ok = st.pos, true
+
+	log.Printf("Gatekeeper.WriteSnapshot() OK (%v keys)\n", len(st.entries))
+	return nil
+}
+
+func writeSnapshot(sw *snapshotWriter, st snapshotState) error {
+	if _, err := sw.w.Write(snapshotMagic); err != nil {
+		return err
+	}
+
+	if err := sw.Uvarint(uint64(st.pos.FNum)); err != nil {
+		return err
+	}
+	if err := sw.Uvarint(st.pos.Offset); err != nil {
+		return err
+	}
+
+	if err := sw.Uvarint(uint64(len(st.chunks))); err != nil {
+		return err
+	}
+	for num, c := range st.chunks {
+		for _, v := range []uint64{uint64(num), uint64(c.version), c.size, uint64(c.corrupted), c.raw, c.stored} {
+			if err := sw.Uvarint(v); err != nil {
+				return err
+			}
+		}
+	}
+
+	for hash, val := range st.blobs {
+		if err := sw.w.WriteByte(3); err != nil {
+			return err
+		}
+		if err := sw.Bytes([]byte(hash)); err != nil {
+			return err
+		}
+		for _, x := range []uint64{uint64(val.FNum), val.Offset, val.Len} {
+			if err := sw.Uvarint(x); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, e := range st.entries {
+		if err := sw.w.WriteByte(1); err != nil {
+			return err
+		}
+		if err := sw.Bytes([]byte(e.key)); err != nil {
+			return err
+		}
+		if err := sw.Uvarint(uint64(len(e.versions))); err != nil {
+			return err
+		}
+		for _, v := range e.versions {
+			for _, x := range []uint64{uint64(v.val.FNum), v.val.Offset, v.val.Len, uint64(v.pos.FNum), v.pos.Offset} {
+				if err := sw.Uvarint(x); err != nil {
+					return err
+				}
+			}
+			if err := sw.Bytes([]byte(v.ref)); err != nil {
+				return err
+			}
+			if err := sw.Uvarint(uint64(v.expires)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for key, t := range st.tombstones {
+		if err := sw.w.WriteByte(2); err != nil {
+			return err
+		}
+		if err := sw.Bytes([]byte(key)); err != nil {
+			return err
+		}
+		for _, x := range []uint64{uint64(t.val.FNum), t.val.Offset, t.val.Len, uint64(t.origin)} {
+			if err := sw.Uvarint(x); err != nil {
+				return err
+			}
+		}
+	}
+
+	return sw.w.WriteByte(0)
+}
+
+type snapshotReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (self *snapshotReader) Uvarint() uint64 {
+	if self.err != nil {
+		return 0
+	}
+
+	v, err := binary.ReadUvarint(self.r)
+	self.err = err
+	return v
+}
+
+func (self *snapshotReader) Bytes() []byte {
+	l := self.Uvarint()
+	if self.err != nil {
+		return nil
+	}
+
+	if l > uint64(self.r.Len()) {
+		self.err = io.ErrUnexpectedEOF
+		return nil
+	}
+
+	res := make([]byte, l)
+	_, self.err = io.ReadFull(self.r, res)
+	return res
+}
+
+// loadSnapshot fills the trie and the chunk table from the snapshot, if
+// there is a valid one for the chunk files in arr, and returns the position
+// to replay the chunks from.
+func (self *Gatekeeper) loadSnapshot(arr valTArr) (uint, uint64, bool) {
+	data, err := ioutil.ReadFile(self.dir + "/" + snapshotName)
+	if os.IsNotExist(err) {
+		return 0, 0, false
+	}
+	if err != nil {
+		log.Errorln(errors.NewErr(err))
+		return 0, 0, false
+	}
+
+	num, offset, err := self.readSnapshot(data, arr)
+	if err != nil {
+		log.Errorln("Snapshot is not usable, loading all chunks:", err)
+		self.resetIndex()
+		return 0, 0, false
+	}
+
+	self.snapshot.pos = Value{FNum: num, Offset: offset}
+	self.snapshot.ok = true
+	log.Printf("Gatekeeper.loadSnapshot() OK (chunk %v, offset %v)\n", num, offset)
+	return num, offset, true
+}
+
+func (self *Gatekeeper) readSnapshot(data []byte, arr valTArr) (uint, uint64, error) {
+	if len(data) < len(snapshotMagic)+4 || !bytes.Equal(data[:len(snapshotMagic)], snapshotMagic) {
+		return 0, 0, errors.New("Bad snapshot header!")
+	}
+
+	body := data[:len(data)-4]
+	if binary.LittleEndian.Uint32(data[len(data)-4:]) != crc32.ChecksumIEEE(body) {
+		return 0, 0, errors.New("Snapshot checksum mismatch!")
+	}
+
+	sr := snapshotReader{
+		r: bytes.NewReader(body[len(snapshotMagic):]),
+	}
+	num := uint(sr.Uvarint())
+	offset := sr.Uvarint()
+
+	files := map[uint]uint64{}
+	for _, f := range arr {
+		files[f.num] = uint64(f.file.Size())
+	}
+
+	// a missing chunk was merged and its live records were copied after it
+	if size, ok := files[num]; ok && size < offset {
+		return 0, 0, errors.New("Snapshot is ahead of the chunks!")
+	}
+
+	cnt := sr.Uvarint()
+	for i := uint64(0); i < cnt && sr.err == nil; i += 1 {
+		c := &chunkT{}
+		n := uint(sr.Uvarint())
+		c.version = int(sr.Uvarint())
+		c.size = sr.Uvarint()
+		c.corrupted = uint(sr.Uvarint())
+		c.raw = sr.Uvarint()
+		c.stored = sr.Uvarint()
+
+		// chunks removed by the merger after the snapshot
+		if _, ok := files[n]; ok {
+			self.chunks[n] = c
+		}
+	}
+
+	for sr.err == nil {
+		tag, err := sr.r.ReadByte()
+		if err != nil {
+			return 0, 0, errors.NewErr(err)
+		}
+		if tag == 0 {
+			break
+		}
+
+		key := sr.Bytes()
+		if tag == 3 {
+			val := Value{
+				FNum:   uint(sr.Uvarint()),
+				Offset: sr.Uvarint(),
+				Len:    sr.Uvarint(),
+			}
+			if sr.err == nil {
+				self.registerBlob(string(key), val)
+			}
+			continue
+		}
+
+		if tag == 2 {
+			t := tombstoneT{
+				val: Value{
+					FNum:   uint(sr.Uvarint()),
+					Offset: sr.Uvarint(),
+					Len:    sr.Uvarint(),
+				},
+				origin: uint(sr.Uvarint()),
+			}
+			if sr.err == nil {
+				self.tombstones[string(key)] = t
+				self.live(t.val)
+			}
+			continue
+		}
+
+		e := &entryT{}
+		cnt := sr.Uvarint()
+		for i := uint64(0); i < cnt && sr.err == nil; i += 1 {
+			v := versionT{
+				val: Value{
+					FNum:   uint(sr.Uvarint()),
+					Offset: sr.Uvarint(),
+					Len:    sr.Uvarint(),
+				},
+				pos: Value{
+					FNum:   uint(sr.Uvarint()),
+					Offset: sr.Uvarint(),
+				},
+				ref:     string(sr.Bytes()),
+				expires: int64(sr.Uvarint()),
+			}
+
+			// the retention might be lower than when the snapshot was taken
+			if sr.err != nil || len(e.versions) > self.versions {
+				continue
+			}
+			e.versions = append(e.versions, v)
+			self.holdVersion(v)
+		}
+		if sr.err == nil && len(e.versions) != 0 {
+			self.trie.Add(key, e)
+			self.bloom.Add(key)
+			self.scheduleExpiry(key, e.versions[0])
+		}
+	}
+	if sr.err != nil {
+		return 0, 0, errors.NewErr(sr.err)
+	}
+
+	return num, offset, nil
+}
+
+func (self *Gatekeeper) RunSnapshots(interval time.Duration) error {
+	log.Printf("Gatekeeper.RunSnapshots()\n")
+	for {
+		time.Sleep(interval)
+		if err := self.WriteSnapshot(); err != nil {
+			return err
+		}
+	}
+}
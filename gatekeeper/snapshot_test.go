@@ -0,0 +1,58 @@
+package gatekeeper
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestSnapshotCopy checks that the copy the snapshot is encoded from doesn't
+// change with the writes made meanwhile, and that those writes are replayed
+// after a restart.
+func TestSnapshotCopy(t *testing.T) {
+	dir := t.TempDir()
+	gk := openTest(t, dir, 1<<20)
+	old := map[string]Value{}
+	keys := map[string]string{}
+	for i := 0; i < 10; i++ {
+		u := fmt.Sprintf("http://h.ru/%d", i)
+		old[u] = writeTest(t, gk, u, "old")
+		keys[u], _ = UrlTransform(u)
+	}
+
+	gk.mutex.RLock()
+	st := gk.snapshotState()
+	gk.mutex.RUnlock()
+
+	last := map[string]Value{}
+	for u := range old {
+		last[u] = writeTest(t, gk, u, "new")
+	}
+	if len(st.entries) != len(old) {
+		t.Fatal("Copied", len(st.entries), "keys")
+	}
+	for _, e := range st.entries {
+		for u, key := range keys {
+			if key == e.key && (len(e.versions) != 1 || e.versions[0].val != old[u]) {
+				t.Fatal("Changed", e.key, e.versions)
+			}
+		}
+	}
+
+	if err := gk.WriteSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	for u := range old {
+		last[u] = writeTest(t, gk, u, "newer")
+	}
+	if err := gk.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	gk = openTest(t, dir, 1<<20)
+	defer gk.Close()
+	for u, val := range last {
+		if got, ok := findTest(t, gk, u); !ok || got != val {
+			t.Fatal("Lost", u, val, got)
+		}
+	}
+}
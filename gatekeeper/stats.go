@@ -0,0 +1,96 @@
+package gatekeeper
+
+import (
+	"net/http"
+	"psearch/util/errors"
+	"sync/atomic"
+	"time"
+)
+
+// Stats sums the chunk table. CompressionRatio is raw to stored size of the
+// bodies on disk, including the overwritten ones. BloomFPRate is estimated
+// for the keys added to the filter, including the deleted ones. Refs counts
+// the versions stored as references to Blobs.
+func (self *Gatekeeper) Stats() Stats {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	res := Stats{
+		Keys:          self.trie.Keys,
+		TrieNodes:     self.trie.Count,
+		CurrentChunk:  self.fNum,
+		CurrentOffset: self.file.offset,
+		Reads:         atomic.LoadUint64(&self.reads.ops),
+		ReadErrors:    atomic.LoadUint64(&self.reads.errors),
+		ReadLatency:   self.reads.histogram(),
+		Writes:        atomic.LoadUint64(&self.writes.ops),
+		WriteErrors:   atomic.LoadUint64(&self.writes.errors),
+		WriteLatency:  self.writes.histogram(),
+		Chunks:        len(self.chunks),
+		BloomBits:     self.bloom.Bits(),
+		BloomHashes:   self.bloom.Hashes(),
+		BloomKeys:     self.bloom.Count,
+		BloomFPRate:   self.bloom.FPRate(),
+		Blobs:         len(self.blobs),
+	}
+	for _, b := range self.blobs {
+		res.Refs += b.refs
+	}
+	if self.file.file != nil {
+		res.SinceSync = time.Since(self.file.synced).Seconds()
+		res.SyncedOffset = self.file.durable
+	}
+	for _, num := range self.chunkNums() {
+		c := self.chunks[num]
+		res.PerChunk = append(res.PerChunk, chunkInfo(num, c))
+		res.Size += c.size
+		res.Live += c.live
+		res.RawBodies += c.raw
+		res.StoredBodies += c.stored
+	}
+
+	if res.StoredBodies != 0 {
+		res.CompressionRatio = float64(res.RawBodies) / float64(res.StoredBodies)
+	}
+	return res
+}
+
+func (self *GatekeeperServer) Stats(args *struct{}, result *Stats) error {
+	*result = self.Gatekeeper.Stats()
+	return nil
+}
+
+// Health takes the lock only for a moment, so it is cheap to probe.
+func (self *Gatekeeper) Health() Health {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	res := Health{
+		Ok:     self.lock != nil,
+		Role:   "master",
+		Master: self.master,
+		Keys:   self.trie.Keys,
+		Uptime: time.Since(self.started).Seconds(),
+	}
+	if self.master != "" {
+		res.Role = "replica"
+	}
+	return res
+}
+
+func (self *GatekeeperServer) Health(args *struct{}, result *Health) error {
+	*result = self.Gatekeeper.Health()
+	return nil
+}
+
+// ServeHealth answers 200 to balancers while the gatekeeper is fine.
+func (self *GatekeeperServer) ServeHealth(w http.ResponseWriter, r *http.Request) error {
+	h := self.Gatekeeper.Health()
+	if !h.Ok {
+		http.Error(w, "closed", http.StatusServiceUnavailable)
+		return nil
+	}
+
+	_, err := w.Write([]byte(h.Role + "\n"))
+	return errors.NewErr(err)
+}
@@ -0,0 +1,451 @@
+package gatekeeper
+
+import (
+	"compress/flate"
+	"container/list"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"psearch/util"
+	"psearch/util/errors"
+	"psearch/util/log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MaxReadRange bounds the window of ReadRange.
+const MaxReadRange = 1024 * 1024
+
+const (
+	// headSize is the first guess of the length of a record up to its body
+	headSize = 4096
+	// maxOpenBodies bounds the compressed bodies kept inflating between
+	// the windows of ReadRange
+	maxOpenBodies = 16
+)
+
+// bodyT reads the body of a record right from its chunk, so a window of a
+// large body doesn't load the rest of it. A compressed body is inflated
+// from its start, reading it forward inflates it once. It must not be read
+// concurrently.
+type bodyT struct {
+	gk         *Gatekeeper
+	h          *handleT
+	val        Value
+	offset     int64
+	stored     int64
+	size       int64
+	compressed bool
+	meta       *Meta
+	// the inflated stream and its position
+	r   io.ReadCloser
+	pos int64
+}
+
+func (self *bodyT) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("Negative offset!")
+	}
+	if off >= self.size {
+		return 0, io.EOF
+	}
+	if !self.compressed {
+		return io.NewSectionReader(self.h.file, self.offset, self.stored).ReadAt(p, off)
+	}
+
+	if self.r == nil || off < self.pos {
+		if self.r != nil {
+			self.r.Close()
+		}
+		self.r = flate.NewReader(io.NewSectionReader(self.h.file, self.offset, self.stored))
+		self.pos = 0
+	}
+	if off > self.pos {
+		n, err := io.CopyN(ioutil.Discard, self.r, off-self.pos)
+		self.pos += n
+		if err != nil {
+			return 0, errors.NewErr(err)
+		}
+	}
+
+	n, err := io.ReadFull(self.r, p)
+	self.pos += int64(n)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		if self.pos != self.size {
+			return n, errors.NewErr(errCorruptRecord)
+		}
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (self *bodyT) Close() {
+	if self.r != nil {
+		self.r.Close()
+	}
+	self.gk.readers.release(self.h)
+}
+
+// bodyCache keeps the compressed bodies read by ReadRange, so the next
+// window goes on inflating from where the previous one stopped instead of
+// from the start.
+type bodyCache struct {
+	mutex  sync.Mutex
+	bodies map[Value]*list.Element
+	lru    list.List
+}
+
+// take returns the body at val and removes it, nobody else reads it then.
+func (self *bodyCache) take(val Value) *bodyT {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	e, ok := self.bodies[val]
+	if !ok {
+		return nil
+	}
+	delete(self.bodies, val)
+	return self.lru.Remove(e).(*bodyT)
+}
+
+func (self *bodyCache) put(b *bodyT) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if _, ok := self.bodies[b.val]; ok || b.pos >= b.size {
+		b.Close()
+		return
+	}
+
+	if self.bodies == nil {
+		self.bodies = map[Value]*list.Element{}
+	}
+	self.bodies[b.val] = self.lru.PushFront(b)
+	for self.lru.Len() > maxOpenBodies {
+		old := self.lru.Remove(self.lru.Back()).(*bodyT)
+		delete(self.bodies, old.val)
+		old.Close()
+	}
+}
+
+func (self *bodyCache) Close() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	for val, e := range self.bodies {
+		e.Value.(*bodyT).Close()
+		delete(self.bodies, val)
+	}
+	self.lru.Init()
+}
+
+// checkCRC streams the payload of the record at val through crc32, head is
+// the beginning of the record.
+func checkCRC(h *handleT, val Value, head []byte) error {
+	l, n := binary.Uvarint(head)
+	if n <= 0 || l < 4 || uint64(n)+l != val.Len || len(head) < n+4 {
+		return errors.NewErr(errCorruptRecord)
+	}
+
+	crc := crc32.NewIEEE()
+	if _, err := io.Copy(crc, io.NewSectionReader(h.file, int64(val.Offset)+int64(n)+4, int64(l)-4)); err != nil {
+		return errors.NewErr(err)
+	}
+	if crc.Sum32() != binary.LittleEndian.Uint32(head[n:]) {
+		return errors.NewErr(errCorruptRecord)
+	}
+	return nil
+}
+
+// readHead reads the record at val up to its body. The crc covers the
+// whole record, so it is checked if check is set or the record is read
+// whole anyway.
+func readHead(h *handleT, val Value, version int, check bool) (record, bodyPos, error) {
+	n := uint64(headSize)
+	for {
+		if n > val.Len {
+			n = val.Len
+		}
+
+		buf := make([]byte, n)
+		if _, err := h.file.ReadAt(buf, int64(val.Offset)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return record{}, bodyPos{}, errors.NewErr(err)
+		}
+
+		rec, pos, err := parseHead(buf, version)
+		if err == errCorruptRecord && n < val.Len {
+			n *= 2
+			continue
+		}
+		if err != nil {
+			return record{}, bodyPos{}, errors.NewErr(err)
+		}
+
+		if pos.offset+pos.stored != val.Len {
+			return record{}, bodyPos{}, errors.NewErr(errCorruptRecord)
+		}
+		if version != chunkV1 && (check || n == val.Len) {
+			if err := checkCRC(h, val, buf); err != nil {
+				return record{}, bodyPos{}, err
+			}
+		}
+		return rec, pos, nil
+	}
+}
+
+// openRecord opens the body stored in the record at val.
+func (self *Gatekeeper) openRecord(val Value, check bool) (*bodyT, record, error) {
+	version, err := self.chunkVersion(val)
+	if err != nil {
+		return nil, record{}, err
+	}
+
+	h, err := self.readers.acquire(self.chunkName(val.FNum), val.FNum)
+	if err != nil {
+		return nil, record{}, err
+	}
+
+	rec, pos, err := readHead(h, val, version, check)
+	if err != nil {
+		self.readers.release(h)
+		return nil, record{}, err
+	}
+
+	return &bodyT{
+		gk:         self,
+		h:          h,
+		val:        val,
+		offset:     int64(val.Offset + pos.offset),
+		stored:     int64(pos.stored),
+		size:       int64(pos.size),
+		compressed: rec.flags&flagCompressed != 0,
+	}, rec, nil
+}
+
+// openRef is readRef without reading the body.
+func (self *Gatekeeper) openRef(hash []byte, check bool) (*bodyT, error) {
+	for {
+		self.mutex.RLock()
+		b, ok := self.blobs[string(hash)]
+		val := Value{}
+		if ok {
+			val = b.val
+		}
+		self.mutex.RUnlock()
+		if val.Len == 0 {
+			return nil, errors.New("Body " + hex.EncodeToString(hash) + " is lost!")
+		}
+
+		body, _, err := self.openRecord(val, check)
+		if err == nil {
+			return body, nil
+		}
+
+		// the merger might have moved the body and removed the chunk
+		self.mutex.RLock()
+		moved := b.val != val
+		self.mutex.RUnlock()
+		if !moved {
+			return nil, err
+		}
+	}
+}
+
+// openBody is readBody without reading the body, the caller closes it.
+func (self *Gatekeeper) openBody(val Value, check bool) (*bodyT, error) {
+	start := time.Now()
+	body, err := self.loadOpenBody(val, check)
+	self.reads.add(start, 1, err)
+	return body, err
+}
+
+func (self *Gatekeeper) loadOpenBody(val Value, check bool) (*bodyT, error) {
+	body, rec, err := self.openRecord(val, check)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := decodeMeta(rec)
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+
+	if rec.flags&flagRef != 0 {
+		body.Close()
+		if body, err = self.openRef(rec.hash, check); err != nil {
+			return nil, err
+		}
+		// the window cache goes by the record asked for
+		body.val = val
+	}
+	body.meta = meta
+	return body, nil
+}
+
+// isVersion tells if val is one of the kept versions of key.
+func (self *Gatekeeper) isVersion(key string, val Value) bool {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	e, ok := self.findEntry([]byte(key))
+	if !ok || expired(e, time.Now().Unix()) {
+		return false
+	}
+	return e.find(val) != -1
+}
+
+// ReadRange returns the window of length bytes at offset of the body at val
+// and the size of the whole body. The record must be one of the versions of
+// key, it may be an older one than the current version. Only the window is
+// read, the crc of the record is checked with the first one.
+func (self *Gatekeeper) ReadRange(key string, val Value, offset, length int64) ([]byte, int64, *Meta, error) {
+	log.Printf("Gatekeeper.ReadRange(%v, %+v, %v, %v)\n", key, val, offset, length)
+	// val comes from the client
+	if !self.isVersion(key, val) {
+		return nil, 0, nil, errors.New("Record " + val.name() + " is not one of " + key + "!")
+	}
+
+	start := time.Now()
+	body := self.bodies.take(val)
+	if body != nil && offset == 0 {
+		body.Close()
+		body = nil
+	}
+	if body == nil {
+		var err error
+		if body, err = self.loadOpenBody(val, offset == 0); err != nil {
+			self.reads.add(start, 1, err)
+			return nil, 0, nil, err
+		}
+	}
+
+	if length <= 0 || length > MaxReadRange {
+		length = MaxReadRange
+	}
+
+	size := body.size
+	if offset < 0 || offset > size {
+		offset = size
+	}
+	if length > size-offset {
+		length = size - offset
+	}
+
+	data := make([]byte, length)
+	n, err := body.ReadAt(data, offset)
+	if err == io.EOF && int64(n) == length {
+		err = nil
+	}
+	self.reads.add(start, 1, err)
+	if err != nil {
+		body.Close()
+		return nil, 0, nil, err
+	}
+
+	meta := body.meta
+	if body.compressed {
+		self.bodies.put(body)
+	} else {
+		body.Close()
+	}
+
+	log.Printf("Gatekeeper.ReadRange(%v, %+v, %v, %v) OK (%v of %v)\n", key, val, offset, length, n, size)
+	return data, size, meta, nil
+}
+
+// ReadRange reads a window of the body. The first call gets the Val of the
+// n-th version, the next ones should pass it to stay on the same record.
+func (self *GatekeeperServer) ReadRange(args *ReadRangeArgs, result *ReadRangeResult) error {
+	key, err := UrlTransform(args.Url)
+	if err != nil {
+		log.Errorln(err, args)
+		return err
+	}
+
+	fn := func(r Value) error {
+		data, size, meta, err := self.Gatekeeper.ReadRange(key, r, args.Offset, args.Len)
+		if err != nil {
+			return err
+		}
+
+		*result = ReadRangeResult{FindResult{Val: &r}, data, size, meta, self.Gatekeeper.expiresOf(key, r)}
+		return nil
+	}
+
+	if args.Val != nil {
+		err = fn(*args.Val)
+	} else {
+		_, err = self.read(key, args.N, fn)
+	}
+	if err != nil {
+		log.Errorln(err, args)
+		return err
+	}
+	return nil
+}
+
+// ServeRaw writes the body of ?url= (the version ?n=, 0 by default) as is,
+// with its content type. http.ServeContent sets Content-Length and serves
+// Range requests, only the ranges asked for are read.
+func (self *GatekeeperServer) ServeRaw(w http.ResponseWriter, r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return util.ClientError(errors.NewErr(err))
+	}
+
+	u, err := util.GetParam(r, "url")
+	if err != nil {
+		return util.ClientError(err)
+	}
+
+	sn, err := util.GetParamOr(r, "n", "0")
+	if err != nil {
+		return util.ClientError(err)
+	}
+	n, err := strconv.Atoi(sn)
+	if err != nil {
+		return util.ClientError(errors.NewErr(err))
+	}
+
+	key, err := UrlTransform(u)
+	if err != nil {
+		return util.ClientError(err)
+	}
+
+	ok, err := self.read(key, n, func(val Value) error {
+		body, err := self.Gatekeeper.openBody(val, r.Header.Get("Range") == "")
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		meta := body.meta
+
+		ct := "application/octet-stream"
+		if meta != nil && meta.ContentType != "" {
+			ct = meta.ContentType
+		}
+		w.Header().Set("Content-Type", ct)
+
+		var mtime time.Time
+		if meta != nil {
+			mtime = meta.FetchTime
+		}
+		http.ServeContent(w, r, "", mtime, io.NewSectionReader(body, 0, body.size))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		http.NotFound(w, r)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package gatekeeper
+
+import (
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// TestReadRangeVal checks that a Val from the client is only used if it is
+// one of the versions of the url.
+func TestReadRangeVal(t *testing.T) {
+	gk := openTest(t, t.TempDir(), 1<<20)
+	defer gk.Close()
+	server := &GatekeeperServer{Gatekeeper: gk}
+
+	val := writeTest(t, gk, "http://a.ru/", "body of a")
+	other := writeTest(t, gk, "http://b.ru/", "body of b")
+
+	var res ReadRangeResult
+	args := ReadRangeArgs{FindArgs: FindArgs{Url: "http://a.ru/"}, Val: &val}
+	if err := server.ReadRange(&args, &res); err != nil || string(res.Data) != "body of a" {
+		t.Fatal("ReadRange", string(res.Data), err)
+	}
+
+	for _, bad := range []Value{
+		other,
+		{FNum: val.FNum, Offset: val.Offset, Len: 1 << 62},
+		{FNum: val.FNum, Offset: 1 << 62, Len: val.Len},
+		{FNum: val.FNum + 100, Offset: val.Offset, Len: val.Len},
+	} {
+		bad := bad
+		args.Val = &bad
+		if err := server.ReadRange(&args, &res); err == nil {
+			t.Fatal("ReadRange accepted", bad)
+		}
+	}
+
+	// readRecord checks the bounds on its own
+	if _, err := gk.readRecord(Value{FNum: val.FNum, Offset: val.Offset, Len: 1 << 62}); err == nil {
+		t.Fatal("readRecord read past the chunk")
+	}
+}
+
+// TestReadRangeWindows reads compressed, stored and deduplicated bodies
+// window by window and through ServeRaw with a Range.
+func TestReadRangeWindows(t *testing.T) {
+	gk := openTest(t, t.TempDir(), 1<<24)
+	defer gk.Close()
+	server := &GatekeeperServer{Gatekeeper: gk}
+
+	r := rand.New(rand.NewSource(1))
+	random := make([]byte, 300000)
+	r.Read(random)
+	text := strings.Repeat("compressible text of a page ", 100000)
+
+	bodies := map[string]string{
+		"http://text.ru/":   text,
+		"http://copy.ru/":   text,
+		"http://random.ru/": string(random),
+	}
+	for u, body := range bodies {
+		writeTest(t, gk, u, body)
+	}
+
+	for u, body := range bodies {
+		var data []byte
+		args := ReadRangeArgs{FindArgs: FindArgs{Url: u}, Len: 100000}
+		for {
+			var res ReadRangeResult
+			if err := server.ReadRange(&args, &res); err != nil {
+				t.Fatal(u, err)
+			}
+			if res.Size != int64(len(body)) {
+				t.Fatal(u, "Size", res.Size)
+			}
+			if len(res.Data) == 0 {
+				break
+			}
+			data = append(data, res.Data...)
+			args.Val = res.Val
+			args.Offset += int64(len(res.Data))
+		}
+		if string(data) != body {
+			t.Fatal(u, "Windows don't make the body")
+		}
+
+		// a window back and one far ahead
+		for _, offset := range []int64{1000, int64(len(body)) - 10} {
+			var res ReadRangeResult
+			args.Offset, args.Len = offset, 5
+			if err := server.ReadRange(&args, &res); err != nil || string(res.Data) != body[offset:offset+5] {
+				t.Fatal(u, "Window at", offset, string(res.Data), err)
+			}
+		}
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/raw?url="+url.QueryEscape(u), nil)
+		req.Header.Set("Range", "bytes=200000-200009")
+		if err := server.ServeRaw(w, req); err != nil {
+			t.Fatal(u, err)
+		}
+		if w.Code != http.StatusPartialContent || w.Body.String() != body[200000:200010] {
+			t.Fatal(u, "ServeRaw", w.Code, w.Body.String())
+		}
+	}
+}
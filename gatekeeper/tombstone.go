@@ -0,0 +1,169 @@
+package gatekeeper
+
+import (
+	"encoding/binary"
+	"psearch/util/log"
+	"time"
+)
+
+// tombstoneT is a deleted key. The tombstone record must outlive every chunk
+// up to origin, the chunk where the key was deleted, because older records
+// of the key might be there and would come back to life on replay.
+type tombstoneT struct {
+	val    Value
+	origin uint
+}
+
+func tombstoneOrigin(rec record, val Value) uint {
+	origin, n := binary.Uvarint(rec.body)
+	if n <= 0 {
+		return val.FNum
+	}
+	return uint(origin)
+}
+
+// deleteValue removes key with all its versions from the trie and remembers
+// the tombstone at val. Tombstones older than the current version are ignored.
+func (self *Gatekeeper) deleteValue(key []byte, val Value, origin uint) {
+	e, ok := self.findEntry(key)
+	if ok && e.versions[0].pos.After(val) {
+		return
+	}
+
+	if t, ok := self.tombstones[string(key)]; ok {
+		if t.val.After(val) {
+			return
+		}
+		self.unlive(t.val)
+	}
+
+	if ok {
+		for _, v := range e.versions {
+			self.releaseVersion(v)
+		}
+		self.trie.Delete(key)
+	}
+
+	self.tombstones[string(key)] = tombstoneT{
+		val:    val,
+		origin: origin,
+	}
+	self.live(val)
+}
+
+// firstChunks returns the two smallest chunk numbers, ok2 is false if there
+// is less than two chunks.
+func (self *Gatekeeper) firstChunks() (uint, uint, bool, bool) {
+	var c1, c2 uint
+	ok1, ok2 := false, false
+	for num := range self.chunks {
+		switch {
+		case !ok1 || num < c1:
+			c1, c2, ok2 = num, c1, ok1
+			ok1 = true
+		case !ok2 || num < c2:
+			c2, ok2 = num, true
+		}
+	}
+	return c1, c2, ok1, ok2
+}
+
+// tombstoneNeeded tells if a chunk other than the tombstone's own one can
+// still hold records the tombstone hides.
+func (self *Gatekeeper) tombstoneNeeded(t tombstoneT) bool {
+	c1, c2, ok1, ok2 := self.firstChunks()
+	if ok1 && c1 <= t.origin && c1 != t.val.FNum {
+		return true
+	}
+	return ok2 && c2 <= t.origin && c2 != t.val.FNum
+}
+
+// pruneTombstones forgets tombstones that hide nothing anymore, the space
+// they take is reclaimed by the merger.
+func (self *Gatekeeper) pruneTombstones() error {
+	for key, t := range self.tombstones {
+		if !self.tombstoneNeeded(t) {
+			if err := self.forgetTombstone(key, t); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// forgetTombstone drops the tombstone of key. A snapshot taken before the
+// tombstone still has the key, and once the merger drops the record nothing
+// replayed after the snapshot deletes it, so such a snapshot goes too.
+func (self *Gatekeeper) forgetTombstone(key string, t tombstoneT) error {
+	if self.snapshot.ok && !self.snapshot.pos.After(t.val) {
+		if err := self.dropSnapshot(); err != nil {
+			return err
+		}
+	} else {
+		// a snapshot being written might have been taken before it
+		self.snapshot.gen += 1
+	}
+
+	self.unlive(t.val)
+	delete(self.tombstones, key)
+	return nil
+}
+
+func (self *Gatekeeper) tombstoneRecord(url string) record {
+	// the tombstone can roll over to the next chunk, an older origin is safe
+	return record{
+		flags: flagTombstone,
+		url:   []byte(url),
+		body:  binary.AppendUvarint(nil, uint64(self.fNum)),
+	}
+}
+
+// Delete appends a tombstone for key and removes it from the trie. It
+// returns false if there was nothing to delete.
+func (self *Gatekeeper) Delete(url, key string) (bool, error) {
+	log.Printf("Gatekeeper.Delete(%v, %v)\n", url, key)
+	mode, err := self.durabilityOf("")
+	if err != nil {
+		return false, err
+	}
+
+	self.mutex.Lock()
+	// an expired key is gone already, its tombstone is up to Expire
+	if e, ok := self.findEntry([]byte(key)); !ok || expired(e, time.Now().Unix()) {
+		self.mutex.Unlock()
+		log.Printf("Gatekeeper.Delete(%v, %v) OK (not found)\n", url, key)
+		return false, nil
+	}
+
+	res, err := self.write(key, self.tombstoneRecord(url))
+	self.mutex.Unlock()
+	if err != nil {
+		return false, err
+	}
+
+	if err := self.commit(mode); err != nil {
+		return false, err
+	}
+
+	log.Printf("Gatekeeper.Delete(%v, %v) OK (%+v)\n", url, key, res)
+	return true, nil
+}
+
+func (self *GatekeeperServer) Delete(args *FindArgs, result *DeleteResult) error {
+	key, err := UrlTransform(args.Url)
+	if err != nil {
+		log.Errorln(err, args)
+		return err
+	}
+
+	ok, err := self.Gatekeeper.Delete(args.Url, key)
+	if err != nil {
+		log.Errorln(err, args)
+		return err
+	}
+
+	*result = DeleteResult{
+		Deleted: ok,
+	}
+	return nil
+}
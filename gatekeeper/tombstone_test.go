@@ -0,0 +1,71 @@
+package gatekeeper
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestDeleteSurvivesMergeAndSnapshot deletes a key the snapshot still has,
+// then the merger removes both the record and the tombstone.
+func TestDeleteSurvivesMergeAndSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	gk := openTest(t, dir, 200)
+
+	const deleted = "http://deleted.ru/"
+	writeTest(t, gk, deleted, "body")
+	writeTest(t, gk, "http://kept.ru/", "body")
+	if err := gk.WriteSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	key, _ := UrlTransform(deleted)
+	if ok, err := gk.Delete(deleted, key); !ok || err != nil {
+		t.Fatal("Delete", ok, err)
+	}
+
+	// seal the chunk of the tombstone, so the merger can take it too
+	for i := 0; i < 10; i++ {
+		writeTest(t, gk, fmt.Sprintf("http://filler.ru/%d", i), fmt.Sprintf("%0100d", i))
+	}
+	for i := 0; i < 2; i++ {
+		if err := gk.Merge(0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := gk.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	gk = openTest(t, dir, 200)
+	defer gk.Close()
+	if val, ok := findTest(t, gk, deleted); ok {
+		t.Fatal("Deleted key is back at", val)
+	}
+	val, ok := findTest(t, gk, "http://kept.ru/")
+	if !ok {
+		t.Fatal("Lost a live key")
+	}
+	if _, _, err := gk.Read(val); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDeleteExpired deletes a key that is past its expiry, which is already
+// gone for Find.
+func TestDeleteExpired(t *testing.T) {
+	gk := openTest(t, t.TempDir(), 1<<20)
+	defer gk.Close()
+
+	const u = "http://expired.ru/"
+	key, _ := UrlTransform(u)
+	if _, err := gk.WriteTTL(u, key, nil, []byte("body"), time.Nanosecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := gk.Find(key); ok {
+		t.Fatal("Expired key is found")
+	}
+	if ok, err := gk.Delete(u, key); ok || err != nil {
+		t.Fatal("Deleted an expired key", ok, err)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"psearch/gatekeeper"
+	"psearch/util/errors"
+	"psearch/util/log"
+	"strings"
+	"time"
+)
+
+// verify returns the number of problems found.
+func verify(gk *gatekeeper.Gatekeeper) (int, error) {
+	problems, err := gk.Verify()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) != 0 {
+		fmt.Printf("%v problems found\n", len(problems))
+		return len(problems), nil
+	}
+
+	fmt.Println("OK")
+	return 0, nil
+}
+
+func dump(gk *gatekeeper.Gatekeeper, chunk int, bodies bool) error {
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	enc := json.NewEncoder(w)
+
+	for _, c := range gk.Chunks() {
+		if chunk != -1 && c.FNum != uint(chunk) {
+			continue
+		}
+
+		err := gk.Dump(c.FNum, bodies, func(r gatekeeper.DumpRecord) error {
+			return errors.NewErr(enc.Encode(r))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func stats(gk *gatekeeper.Gatekeeper) {
+	fmt.Printf("chunk\tsize\tlive\tdead\tdead%%\tcorrupted\n")
+	for _, c := range gk.Chunks() {
+		dead := 0.0
+		if c.Size != 0 {
+			dead = 100 * float64(c.Dead) / float64(c.Size)
+		}
+		fmt.Printf("%v\t%v\t%v\t%v\t%.1f\t%v\n", c.FNum, c.Size, c.Live, c.Dead, dead, c.Corrupted)
+	}
+
+	s := gk.Stats()
+	fmt.Printf("total\t%v\t%v\t%v\n", s.Size, s.Live, s.Size-s.Live)
+	fmt.Printf("keys %v, trie nodes %v\n", s.Keys, s.TrieNodes)
+	fmt.Printf("compression %.2f, blobs %v, refs %v\n", s.CompressionRatio, s.Blobs, s.Refs)
+}
+
+func export(gk *gatekeeper.Gatekeeper, name string) error {
+	out := os.Stdout
+	if name != "-" {
+		f, err := os.Create(name)
+		if err != nil {
+			return errors.NewErr(err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	w := bufio.NewWriter(out)
+	cnt, err := gk.ExportWarc(w, strings.HasSuffix(name, ".gz"))
+	if err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return errors.NewErr(err)
+	}
+
+	fmt.Fprintf(os.Stderr, "%v records exported\n", cnt)
+	return errors.NewErr(out.Sync())
+}
+
+// importWarc writes the documents of node out of nodes, or all of them if
+// nodes is 0, to a gatekeeper directory.
+func importWarc(gk *gatekeeper.Gatekeeper, name string, nodes, node int) error {
+	in := os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return errors.NewErr(err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var keep func(string) bool
+	if nodes > 0 {
+		ring := gatekeeper.NewRing(nodes)
+		keep = func(u string) bool {
+			n, err := ring.PlaceOf(u)
+			return err == nil && n == node
+		}
+	}
+
+	cnt, err := gk.ImportWarc(in, keep)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "%v documents imported\n", cnt)
+	return nil
+}
+
+func main() {
+	var help = flag.Bool("help", false, "print help")
+	var dir = flag.String("dir", "", "data directory, no gatekeeper may hold it")
+	var versions = flag.Int("versions", 0, "number of older versions the gatekeeper keeps for every url, must match its -versions or the older ones count as dead")
+	var chunk = flag.Int("chunk", -1, "chunk to dump, -1 for all")
+	var bodies = flag.Bool("bodies", false, "dump bodies too")
+	var file = flag.String("file", "-", "WARC file to export to or import from, .gz to compress the export")
+	var maxFileSize = flag.Int("max-size", 10*1024*1024, "maximum chunk size for import")
+	var nodes = flag.Int("nodes", 0, "number of front nodes, import only the urls of -node if set")
+	var node = flag.Int("node", 0, "front node to import")
+	flag.Parse()
+
+	if *help || *dir == "" || flag.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: tool -dir DIR [flags] verify|dump|stats|export|import\n")
+		flag.PrintDefaults()
+		return
+	}
+
+	if flag.Arg(0) == "import" {
+		gk, err := gatekeeper.NewGatekeeperNoWait(*dir, uint64(*maxFileSize), time.Minute, *versions, 1000*1000, 0.01)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = importWarc(gk, *file, *nodes, *node)
+		if cerr := gk.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	gk, err := gatekeeper.Inspect(*dir, *versions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer gk.Close()
+
+	problems := 0
+	switch flag.Arg(0) {
+	case "verify":
+		problems, err = verify(gk)
+	case "dump":
+		err = dump(gk, *chunk, *bodies)
+	case "stats":
+		stats(gk)
+	case "export":
+		err = export(gk, *file)
+	default:
+		err = errors.New("Unknown command " + flag.Arg(0) + "!")
+	}
+
+	if err != nil {
+		gk.Close()
+		log.Fatal(err)
+	}
+	if problems != 0 {
+		gk.Close()
+		os.Exit(1)
+	}
+}
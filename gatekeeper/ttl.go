@@ -0,0 +1,245 @@
+package gatekeeper
+
+import (
+	"container/heap"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"psearch/util/errors"
+	"psearch/util/log"
+	"psearch/util/trie"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TTLRule is the default time to live in seconds of the urls of Host and its
+// subdomains whose path starts with Prefix. An empty Host is any host, a TTL
+// of 0 keeps the urls forever. The most specific rule wins: the longest
+// host, then the longest prefix.
+type TTLRule struct {
+	Host   string `json:"host,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+	TTL    int    `json:"ttl"`
+}
+
+// hostKey is the host reversed like UrlTransform does with a dot at the
+// end, so the key of a host is a prefix of the keys of its subdomains.
+func hostKey(host string) []byte {
+	if host == "" {
+		return nil
+	}
+
+	arr := strings.Split(host, ".")
+	for i, j := 0, len(arr)-1; i < j; i, j = i+1, j-1 {
+		arr[i], arr[j] = arr[j], arr[i]
+	}
+	return []byte(strings.Join(arr, ".") + ".")
+}
+
+// ttlRulesT keeps the rules of every host by hostKey, the longest prefix
+// first.
+type ttlRulesT struct {
+	hosts trie.Trie[[]TTLRule]
+}
+
+func newTTLRules(rules []TTLRule) *ttlRulesT {
+	res := &ttlRulesT{}
+	for _, r := range rules {
+		key := hostKey(r.Host)
+		arr, _ := res.hosts.Find(key)
+		res.hosts.Add(key, append(arr, r))
+	}
+	res.hosts.Walk(nil, func(key []byte, arr []TTLRule) bool {
+		sort.SliceStable(arr, func(i, j int) bool {
+			return len(arr[i].Prefix) > len(arr[j].Prefix)
+		})
+		return true
+	})
+	return res
+}
+
+// match returns the rule of the longest host of u that has a rule for its
+// path.
+func (self *ttlRulesT) match(u *url.URL) (TTLRule, bool) {
+	key := hostKey(u.Hostname())
+	for {
+		host, arr, ok := self.hosts.LongestPrefix(key)
+		if !ok {
+			return TTLRule{}, false
+		}
+		for _, r := range arr {
+			if strings.HasPrefix(u.Path, r.Prefix) {
+				return r, true
+			}
+		}
+
+		// the rules for any host are the last ones
+		if len(host) == 0 {
+			return TTLRule{}, false
+		}
+		key = host[:len(host)-1]
+	}
+}
+
+// LoadTTLRules reads a json array of TTLRule, like
+//
+//	[{"host": "lenta.ru", "ttl": 86400}, {"host": "yandex.ru", "prefix": "/search", "ttl": 3600}]
+func LoadTTLRules(name string) ([]TTLRule, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, errors.NewErr(err)
+	}
+
+	var res []TTLRule
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, errors.NewErr(err)
+	}
+	return res, nil
+}
+
+// SetTTLRules replaces the defaults for the writes without a TTL, the
+// stored documents keep their expiry.
+func (self *Gatekeeper) SetTTLRules(rules []TTLRule) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.ttlRules = newTTLRules(rules)
+}
+
+func (self *Gatekeeper) defaultTTL(u string) time.Duration {
+	parsed, err := url.Parse(u)
+	if err != nil || self.ttlRules == nil {
+		return 0
+	}
+
+	r, ok := self.ttlRules.match(parsed)
+	if !ok {
+		return 0
+	}
+	return time.Duration(r.TTL) * time.Second
+}
+
+// expiry makes the record expire at the unix time expires if it is set,
+// otherwise after ttl, or after the default TTL of the url if ttl is 0. A
+// negative ttl keeps it forever.
+func (self *Gatekeeper) expiry(rec *record, ttl time.Duration, expires int64) {
+	if expires != 0 {
+		rec.flags |= flagExpires
+		rec.expires = expires
+		return
+	}
+	if ttl == 0 {
+		ttl = self.defaultTTL(string(rec.url))
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	rec.flags |= flagExpires
+	rec.expires = time.Now().Add(ttl).Unix()
+}
+
+type expiryT struct {
+	at  int64
+	key string
+}
+
+// expiryHeap orders the keys with a TTL by the expiry of the version they
+// had, the entries of rewritten keys stay until they are due.
+type expiryHeap []expiryT
+
+func (self expiryHeap) Len() int {
+	return len(self)
+}
+
+func (self expiryHeap) Less(i, j int) bool {
+	return self[i].at < self[j].at
+}
+
+func (self expiryHeap) Swap(i, j int) {
+	self[i], self[j] = self[j], self[i]
+}
+
+func (self *expiryHeap) Push(x interface{}) {
+	*self = append(*self, x.(expiryT))
+}
+
+func (self *expiryHeap) Pop() interface{} {
+	old := *self
+	x := old[len(old)-1]
+	*self = old[:len(old)-1]
+	return x
+}
+
+func (self *Gatekeeper) scheduleExpiry(key []byte, v versionT) {
+	if v.expires != 0 {
+		heap.Push(&self.expiries, expiryT{v.expires, string(key)})
+	}
+}
+
+// expired tells if the current version of the entry is past its expiry,
+// such keys are not found until the tombstone removes them.
+func expired(e *entryT, now int64) bool {
+	at := e.versions[0].expires
+	return at != 0 && at <= now
+}
+
+// expiresOf returns when the version val of key expires, 0 if never.
+func (self *Gatekeeper) expiresOf(key string, val Value) int64 {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	e, ok := self.findEntry([]byte(key))
+	if !ok {
+		return 0
+	}
+	if i := e.find(val); i != -1 {
+		return e.versions[i].expires
+	}
+	return 0
+}
+
+// Expire appends tombstones for the keys whose current version expired, so
+// the merger reclaims their records. Replicas get the tombstones from the
+// master and keep the due keys in case they become one.
+func (self *Gatekeeper) Expire() (int, error) {
+	log.Printf("Gatekeeper.Expire()\n")
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.master != "" {
+		return 0, nil
+	}
+
+	now := time.Now().Unix()
+	cnt := 0
+	for len(self.expiries) != 0 && self.expiries[0].at <= now {
+		x := heap.Pop(&self.expiries).(expiryT)
+		e, ok := self.findEntry([]byte(x.key))
+		if !ok || e.versions[0].expires != x.at {
+			continue
+		}
+
+		u, err := UrlTransform(x.key)
+		if err != nil {
+			return cnt, err
+		}
+
+		rec := self.tombstoneRecord(u)
+		val, err := self.appendRecord(rec)
+		if err != nil {
+			return cnt, err
+		}
+		self.apply([]byte(x.key), rec, val)
+		cnt += 1
+	}
+
+	if cnt != 0 {
+		if err := self.file.Sync(); err != nil {
+			return cnt, errors.NewErr(err)
+		}
+	}
+
+	log.Printf("Gatekeeper.Expire() OK (%v expired)\n", cnt)
+	return cnt, nil
+}
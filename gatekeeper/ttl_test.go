@@ -0,0 +1,45 @@
+package gatekeeper
+
+import (
+	"testing"
+	"time"
+)
+
+// TestTTLRules checks that the most specific rule wins: the longest host,
+// then the longest prefix.
+func TestTTLRules(t *testing.T) {
+	gk := openTest(t, t.TempDir(), 1<<20)
+	defer gk.Close()
+	gk.SetTTLRules([]TTLRule{
+		{TTL: 1},
+		{Host: "ru", TTL: 2},
+		{Host: "lenta.ru", TTL: 3},
+		{Host: "lenta.ru", Prefix: "/news", TTL: 4},
+		{Host: "news.lenta.ru", Prefix: "/sport", TTL: 5},
+		{Host: "yandex.ru", Prefix: "/search", TTL: 6},
+	})
+
+	for u, ttl := range map[string]int{
+		"http://google.com/":              1,
+		"http://mail.ru/":                 2,
+		"http://lenta.ru/":                3,
+		"http://lenta.ru:8080/":           3,
+		"http://news.lenta.ru:80/sport/1": 5,
+		"http://xlenta.ru/news":           2,
+		"http://lenta.ru/news/1":          4,
+		"http://m.lenta.ru/news/1":        4,
+		"http://news.lenta.ru/news/1":     4,
+		"http://news.lenta.ru/sport/1":    5,
+		"http://yandex.ru/":               2,
+		"http://yandex.ru/search?text=a":  6,
+	} {
+		if got := gk.defaultTTL(u); got != time.Duration(ttl)*time.Second {
+			t.Error(u, "got", got, "want", ttl)
+		}
+	}
+
+	gk.SetTTLRules(nil)
+	if got := gk.defaultTTL("http://lenta.ru/"); got != 0 {
+		t.Error("No rules, got", got)
+	}
+}
@@ -0,0 +1,177 @@
+package gatekeeper
+
+import (
+	"psearch/util/log"
+	"time"
+)
+
+// versionT is a record of a key. The merger moves records to newer chunks,
+// so versions are ordered by pos, where the record was first written.
+type versionT struct {
+	val Value
+	pos Value
+	// the hash of the body if the record is a reference
+	ref string
+	// unix time, 0 if the record never expires
+	expires int64
+}
+
+// entryT is what the trie holds for a key: the current version and up to
+// Gatekeeper.versions older ones, newest first.
+type entryT struct {
+	versions []versionT
+}
+
+func (self *entryT) find(val Value) int {
+	for i, v := range self.versions {
+		if v.val == val {
+			return i
+		}
+	}
+	return -1
+}
+
+// recordPos returns where the record at val was first written.
+func recordPos(rec record, val Value) Value {
+	if rec.flags&flagMoved != 0 {
+		return rec.pos
+	}
+
+	return Value{
+		FNum:   val.FNum,
+		Offset: val.Offset,
+	}
+}
+
+func (self *Gatekeeper) findEntry(key []byte) (*entryT, bool) {
+	// most lookups of the spider are for urls we have never seen
+	if !self.bloom.Test(key) {
+		return nil, false
+	}
+
+	return self.trie.Find(key)
+}
+
+// setValue adds the version v of key and releases the records of the
+// versions that fall out of the history. Versions may
+// come in any order, since replicas may receive chunks out of order.
+func (self *Gatekeeper) setValue(key []byte, v versionT) {
+	if t, ok := self.tombstones[string(key)]; ok {
+		if t.val.After(v.pos) {
+			return
+		}
+
+		self.unlive(t.val)
+		delete(self.tombstones, string(key))
+	}
+
+	e, ok := self.findEntry(key)
+	if !ok {
+		e = &entryT{}
+		self.trie.Add(key, e)
+		self.bloom.Add(key)
+	}
+
+	i := 0
+	for ; i < len(e.versions); i++ {
+		cur := &e.versions[i]
+		if cur.pos == v.pos {
+			// two copies of a record, the merger was stopped before it
+			// removed the original
+			if v.val.After(cur.val) {
+				self.release(cur.val)
+				cur.val = v.val
+				self.hold(v.val)
+			}
+			return
+		}
+
+		if v.pos.After(cur.pos) {
+			break
+		}
+	}
+
+	e.versions = append(e.versions, versionT{})
+	copy(e.versions[i+1:], e.versions[i:])
+	e.versions[i] = v
+	self.holdVersion(v)
+
+	for len(e.versions) > self.versions+1 {
+		self.releaseVersion(e.versions[len(e.versions)-1])
+		e.versions = e.versions[:len(e.versions)-1]
+	}
+}
+
+// Version returns the n-th version of key, the current one is 0.
+func (self *Gatekeeper) Version(key string, n int) (Value, bool) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	e, ok := self.findEntry([]byte(key))
+	if !ok || n < 0 || n >= len(e.versions) || expired(e, time.Now().Unix()) {
+		return Value{}, false
+	}
+	return e.versions[n].val, true
+}
+
+// isCurrent tells if val is the newest version of key, a zero Value if key
+// is not found. An expired version is still the newest one, so a copy of
+// the versions of a key goes on past it. The caller holds the lock.
+func (self *Gatekeeper) isCurrent(key string, val Value) bool {
+	e, ok := self.findEntry([]byte(key))
+	if val.Len == 0 {
+		return !ok || expired(e, time.Now().Unix())
+	}
+	return ok && e.versions[0].val == val
+}
+
+// Versions returns all the kept versions of key, newest first.
+func (self *Gatekeeper) Versions(key string) []Value {
+	log.Printf("Gatekeeper.Versions(%v)\n", key)
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+
+	res := []Value{}
+	if e, ok := self.findEntry([]byte(key)); ok && !expired(e, time.Now().Unix()) {
+		for _, v := range e.versions {
+			res = append(res, v.val)
+		}
+	}
+	return res
+}
+
+func (self *GatekeeperServer) ListVersions(args *FindArgs, result *VersionsResult) error {
+	key, err := UrlTransform(args.Url)
+	if err != nil {
+		log.Errorln(err, args)
+		return err
+	}
+
+	*result = VersionsResult{
+		Vals: self.Gatekeeper.Versions(key),
+	}
+	return nil
+}
+
+func (self *GatekeeperServer) ReadVersion(args *VersionArgs, result *ReadResult) error {
+	key, err := UrlTransform(args.Url)
+	if err != nil {
+		log.Errorln(err, args)
+		return err
+	}
+
+	_, err = self.read(key, args.N, func(r Value) error {
+		data, meta, err := self.Gatekeeper.Read(r)
+		if err != nil {
+			return err
+		}
+
+		*result = ReadResult{FindResult{Val: &r}, &data, meta, self.Gatekeeper.expiresOf(key, r)}
+		return nil
+	})
+	if err != nil {
+		log.Errorln(err, args)
+		return err
+	}
+	return nil
+}
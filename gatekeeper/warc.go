@@ -0,0 +1,331 @@
+package gatekeeper
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"psearch/util/errors"
+	"psearch/util/log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WARC 1.0 has no fractions of a second
+const warcDate = "2006-01-02T15:04:05Z"
+
+const (
+	// warcHash keeps Meta.Hash, WARC allows extension fields
+	warcHash = "Psearch-Hash"
+	// warcNoMeta marks the documents written without meta, their WARC-Date
+	// is the time of the export
+	warcNoMeta = "Psearch-No-Meta"
+	// maxWarcBlock bounds the record read in memory on import, so a broken
+	// Content-Length isn't allocated
+	maxWarcBlock = 256 << 20
+)
+
+type warcWriter struct {
+	w  io.Writer
+	gz bool
+}
+
+// Write writes one WARC record, a separate gzip member if gz is set, as
+// in .warc.gz files.
+func (self *warcWriter) Write(hdr []string, block []byte) error {
+	var buf bytes.Buffer
+	buf.WriteString("WARC/1.0\r\n")
+	for i := 0; i < len(hdr); i += 2 {
+		buf.WriteString(hdr[i] + ": " + hdr[i+1] + "\r\n")
+	}
+	buf.WriteString("Content-Length: " + strconv.Itoa(len(block)) + "\r\n\r\n")
+
+	w := self.w
+	var z *gzip.Writer
+	if self.gz {
+		z = gzip.NewWriter(self.w)
+		w = z
+	}
+
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return errors.NewErr(err)
+	}
+	if _, err := w.Write(block); err != nil {
+		return errors.NewErr(err)
+	}
+	if _, err := w.Write([]byte("\r\n\r\n")); err != nil {
+		return errors.NewErr(err)
+	}
+
+	if z != nil {
+		return errors.NewErr(z.Close())
+	}
+	return nil
+}
+
+func warcRecordId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.NewErr(err)
+	}
+
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// warcRecord makes a response record for documents with an http status
+// and a resource record for the rest.
+func warcRecord(u string, body []byte, meta *Meta, now time.Time) ([]string, []byte, error) {
+	id, err := warcRecordId()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	digest := sha1.Sum(body)
+	hdr := []string{
+		"WARC-Record-ID", id,
+		"WARC-Target-URI", u,
+		"WARC-Payload-Digest", "sha1:" + base32.StdEncoding.EncodeToString(digest[:]),
+	}
+
+	if meta == nil {
+		hdr = append(hdr,
+			"WARC-Date", now.UTC().Format(warcDate),
+			"Content-Type", "application/octet-stream",
+			warcNoMeta, "true")
+		return append([]string{"WARC-Type", "resource"}, hdr...), body, nil
+	}
+
+	hdr = append(hdr, "WARC-Date", meta.FetchTime.UTC().Format(warcDate))
+	if meta.ContentType != "" {
+		hdr = append(hdr, "WARC-Identified-Payload-Type", meta.ContentType)
+	}
+	if meta.Hash != "" {
+		hdr = append(hdr, warcHash, meta.Hash)
+	}
+
+	if meta.Status == 0 {
+		ct := meta.ContentType
+		if ct == "" {
+			ct = "application/octet-stream"
+		}
+		hdr = append(hdr, "Content-Type", ct)
+		return append([]string{"WARC-Type", "resource"}, hdr...), body, nil
+	}
+
+	h := http.Header{}
+	for k, v := range meta.Headers {
+		h[k] = v
+	}
+	// the body is stored decoded
+	h.Del("Transfer-Encoding")
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+
+	var block bytes.Buffer
+	fmt.Fprintf(&block, "HTTP/1.1 %d %s\r\n", meta.Status, http.StatusText(meta.Status))
+	if err := h.Write(&block); err != nil {
+		return nil, nil, errors.NewErr(err)
+	}
+	block.WriteString("\r\n")
+	block.Write(body)
+
+	hdr = append(hdr, "Content-Type", "application/http; msgtype=response")
+	return append([]string{"WARC-Type", "response"}, hdr...), block.Bytes(), nil
+}
+
+// ExportWarc writes every kept version of every url to w as WARC 1.0
+// records, oldest first, so an import rebuilds the history. Only one body
+// is in memory at a time. It returns the number of records written.
+func (self *Gatekeeper) ExportWarc(w io.Writer, gz bool) (int, error) {
+	log.Printf("Gatekeeper.ExportWarc()\n")
+	ww := warcWriter{w, gz}
+	now := time.Now()
+
+	id, err := warcRecordId()
+	if err != nil {
+		return 0, err
+	}
+	info := []string{
+		"WARC-Type", "warcinfo",
+		"WARC-Record-ID", id,
+		"WARC-Date", now.UTC().Format(warcDate),
+		"Content-Type", "application/warc-fields",
+	}
+	if err := ww.Write(info, []byte("software: psearch gatekeeper\r\nformat: WARC File Format 1.0\r\n")); err != nil {
+		return 0, err
+	}
+
+	cnt := 0
+	after := ""
+	for {
+		items, next := self.Scan("", after, MaxScanLimit)
+		for _, it := range items {
+			u, err := UrlTransform(it.Key)
+			if err != nil {
+				return cnt, err
+			}
+
+			vals := self.Versions(it.Key)
+			for i := len(vals) - 1; i >= 0; i-- {
+				body, meta, err := self.Read(vals[i])
+				if err != nil {
+					return cnt, err
+				}
+
+				hdr, block, err := warcRecord(u, []byte(body), meta, now)
+				if err != nil {
+					return cnt, err
+				}
+				if err := ww.Write(hdr, block); err != nil {
+					return cnt, err
+				}
+				cnt += 1
+			}
+		}
+
+		if next == "" {
+			break
+		}
+		after = next
+	}
+
+	log.Printf("Gatekeeper.ExportWarc() OK (%v records)\n", cnt)
+	return cnt, nil
+}
+
+// warcDoc turns a response or resource record into what Write takes. Other
+// records are skipped with ok false.
+func warcDoc(hdr textproto.MIMEHeader, block []byte) (string, *Meta, []byte, bool, error) {
+	typ := hdr.Get("WARC-Type")
+	if typ != "response" && typ != "resource" {
+		return "", nil, nil, false, nil
+	}
+	u := strings.Trim(hdr.Get("WARC-Target-URI"), "<>")
+	if hdr.Get(warcNoMeta) != "" {
+		return u, nil, block, true, nil
+	}
+
+	date, err := time.Parse(time.RFC3339, hdr.Get("WARC-Date"))
+	if err != nil {
+		return "", nil, nil, false, errors.NewErr(err)
+	}
+
+	meta := &Meta{
+		ContentType: hdr.Get("WARC-Identified-Payload-Type"),
+		FetchTime:   date,
+		Hash:        hdr.Get(warcHash),
+	}
+
+	if typ == "resource" || !strings.HasPrefix(hdr.Get("Content-Type"), "application/http") {
+		if meta.ContentType == "" {
+			meta.ContentType = hdr.Get("Content-Type")
+		}
+		return u, meta, block, true, nil
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(block)), nil)
+	if err != nil {
+		return "", nil, nil, false, errors.NewErr(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", nil, nil, false, errors.NewErr(err)
+	}
+
+	meta.Status = resp.StatusCode
+	meta.Headers = resp.Header
+	if meta.ContentType == "" {
+		meta.ContentType = resp.Header.Get("Content-Type")
+	}
+	return u, meta, body, true, nil
+}
+
+// ImportWarc writes the documents of the WARC from r through Write, with the
+// WARC-Date as the fetch time, one record in memory at a time. Gzipped
+// archives are recognized by the magic. Urls for which keep returns false
+// are skipped, nil keeps everything. The documents are written in the seal
+// mode and synced once at the end, an fsync per document makes a bulk
+// import crawl. It returns the number of documents written.
+func (self *Gatekeeper) ImportWarc(r io.Reader, keep func(u string) bool) (int, error) {
+	log.Printf("Gatekeeper.ImportWarc()\n")
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		z, err := gzip.NewReader(br)
+		if err != nil {
+			return 0, errors.NewErr(err)
+		}
+		defer z.Close()
+		br = bufio.NewReader(z)
+	}
+	tp := textproto.NewReader(br)
+
+	cnt := 0
+	for {
+		line, err := tp.ReadLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return cnt, errors.NewErr(err)
+		}
+		// the blank lines after a block
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "WARC/") {
+			return cnt, errors.New("Bad WARC record header " + strconv.Quote(line) + "!")
+		}
+
+		hdr, err := tp.ReadMIMEHeader()
+		if err != nil {
+			return cnt, errors.NewErr(err)
+		}
+
+		l, err := strconv.ParseUint(hdr.Get("Content-Length"), 10, 63)
+		if err != nil {
+			return cnt, errors.NewErr(err)
+		}
+		if l > maxWarcBlock {
+			return cnt, errors.New("WARC record of " + strconv.FormatUint(l, 10) + " bytes is too large!")
+		}
+		block := make([]byte, l)
+		if _, err := io.ReadFull(br, block); err != nil {
+			return cnt, errors.NewErr(err)
+		}
+
+		u, meta, body, ok, err := warcDoc(hdr, block)
+		if err != nil {
+			return cnt, err
+		}
+		if !ok || (keep != nil && !keep(u)) {
+			continue
+		}
+
+		key, err := UrlTransform(u)
+		if err != nil {
+			return cnt, err
+		}
+		if _, err := self.WriteWith(u, key, meta, body, WriteOptions{Durability: DurabilitySeal}); err != nil {
+			return cnt, err
+		}
+		cnt += 1
+	}
+
+	if err := self.syncFile(); err != nil {
+		return cnt, err
+	}
+
+	log.Printf("Gatekeeper.ImportWarc() OK (%v documents)\n", cnt)
+	return cnt, nil
+}
@@ -0,0 +1,70 @@
+package gatekeeper
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestImportWarc imports an export into a directory opened without waiting
+// for its lock, the import is synced when it returns.
+func TestImportWarc(t *testing.T) {
+	src := openTest(t, t.TempDir(), 1<<20)
+	defer src.Close()
+	for i := 0; i < 100; i++ {
+		writeTest(t, src, fmt.Sprintf("http://h%d.ru/", i), fmt.Sprintf("body %d", i))
+	}
+	fetched := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	key, _ := UrlTransform("http://meta.ru/")
+	if _, err := src.Write("http://meta.ru/", key, &Meta{ContentType: "text/plain", FetchTime: fetched}, []byte("meta")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if n, err := src.ExportWarc(&buf, false); err != nil || n != 101 {
+		t.Fatal("ExportWarc", n, err)
+	}
+
+	dir := t.TempDir()
+	gk, err := NewGatekeeperNoWait(dir, 1<<20, time.Minute, 0, 1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gk.Close()
+
+	// the directory is taken, a second import fails instead of waiting
+	if _, err := NewGatekeeperNoWait(dir, 1<<20, time.Minute, 0, 1000, 0.01); err == nil || !strings.Contains(err.Error(), "is held by") {
+		t.Fatal("Opened a held directory", err)
+	}
+
+	if n, err := gk.ImportWarc(&buf, nil); err != nil || n != 101 {
+		t.Fatal("ImportWarc", n, err)
+	}
+	if st := gk.Stats(); st.SyncedOffset != gk.file.offset {
+		t.Fatal("Import is not synced", st.SyncedOffset, gk.file.offset)
+	}
+	if val, ok := findTest(t, gk, "http://h7.ru/"); !ok {
+		t.Fatal("Lost a document")
+	} else if body, meta, err := gk.Read(val); err != nil || body != "body 7" || meta != nil {
+		t.Fatal("Read", body, meta, err)
+	}
+	if val, ok := findTest(t, gk, "http://meta.ru/"); !ok {
+		t.Fatal("Lost a document")
+	} else if _, meta, err := gk.Read(val); err != nil || meta == nil || !meta.FetchTime.Equal(fetched) || meta.ContentType != "text/plain" {
+		t.Fatal("Read", meta, err)
+	}
+}
+
+// TestImportWarcTooLarge checks that a huge Content-Length is rejected
+// before the block is allocated.
+func TestImportWarcTooLarge(t *testing.T) {
+	gk := openTest(t, t.TempDir(), 1<<20)
+	defer gk.Close()
+
+	r := strings.NewReader("WARC/1.0\r\nWARC-Type: resource\r\nContent-Length: 1000000000000\r\n\r\n")
+	if _, err := gk.ImportWarc(r, nil); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Fatal("ImportWarc", err)
+	}
+}
@@ -0,0 +1,79 @@
+package bloom
+
+import (
+	"hash/fnv"
+	"math"
+)
+
+// Filter is a Bloom filter: Test never misses an added key, and is wrong
+// about keys that were never added with about FPRate probability.
+type Filter struct {
+	bits  []uint64
+	m     uint64
+	k     uint
+	Count uint
+}
+
+// New makes a filter for n keys with the false positive rate p.
+func New(n uint, p float64) *Filter {
+	if n == 0 {
+		n = 1
+	}
+	if p <= 0 || p >= 1 {
+		p = 0.01
+	}
+
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	k := uint(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k == 0 {
+		k = 1
+	}
+
+	return &Filter{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+func (self *Filter) hashes(key []byte) (uint64, uint64) {
+	h1 := fnv.New64a()
+	h1.Write(key)
+	h2 := fnv.New64()
+	h2.Write(key)
+	// an odd step walks over all the bits
+	return h1.Sum64(), h2.Sum64() | 1
+}
+
+func (self *Filter) Add(key []byte) {
+	a, b := self.hashes(key)
+	for i := uint(0); i < self.k; i += 1 {
+		n := (a + uint64(i)*b) % self.m
+		self.bits[n/64] |= 1 << (n % 64)
+	}
+	self.Count += 1
+}
+
+func (self *Filter) Test(key []byte) bool {
+	a, b := self.hashes(key)
+	for i := uint(0); i < self.k; i += 1 {
+		n := (a + uint64(i)*b) % self.m
+		if self.bits[n/64]&(1<<(n%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (self *Filter) Bits() uint64 {
+	return self.m
+}
+
+func (self *Filter) Hashes() uint {
+	return self.k
+}
+
+// FPRate estimates the false positive rate for the keys added so far.
+func (self *Filter) FPRate() float64 {
+	return math.Pow(1-math.Exp(-float64(self.k)*float64(self.Count)/float64(self.m)), float64(self.k))
+}
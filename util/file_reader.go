@@ -1,17 +1,22 @@
 package util
 
 import (
+	"bufio"
 	"encoding/binary"
 	"io"
+	"math"
 	"os"
 	"psearch/util/errors"
 	"strconv"
 )
 
+const readerBufSize = 64 * 1024
+
+// FileReader is a buffered reader of a file that counts the bytes read.
 type FileReader struct {
 	file   *os.File
+	reader *bufio.Reader
 	offset uint64
-	buf    []byte
 }
 
 func Open(file string) (*FileReader, error) {
@@ -22,8 +27,8 @@ func Open(file string) (*FileReader, error) {
 
 	return &FileReader{
 		file:   f,
+		reader: bufio.NewReaderSize(f, readerBufSize),
 		offset: 0,
-		buf:    []byte{0},
 	}, nil
 }
 
@@ -32,16 +37,24 @@ func (self *FileReader) Close() error {
 }
 
 func (self *FileReader) Seek(offset int64, whence int) (ret int64, err error) {
+	// the file is ahead of us by what is buffered
+	if whence == io.SeekCurrent {
+		offset -= int64(self.reader.Buffered())
+	}
+
 	ret, err = self.file.Seek(offset, whence)
-	if err == io.EOF {
-		return ret, err
+	if err != nil && err != io.EOF {
+		return ret, errors.NewErr(err)
 	}
 
-	return ret, errors.NewErr(err)
+	self.reader.Reset(self.file)
+	self.offset = uint64(ret)
+	return ret, err
 }
 
 func (self *FileReader) Read(b []byte) (n int, err error) {
-	n, err = self.file.Read(b)
+	n, err = self.reader.Read(b)
+	self.offset += uint64(n)
 	if err == io.EOF {
 		return n, err
 	}
@@ -50,7 +63,7 @@ func (self *FileReader) Read(b []byte) (n int, err error) {
 }
 
 func (self *FileReader) ReadByte() (byte, error) {
-	n, err := self.file.Read(self.buf)
+	b, err := self.reader.ReadByte()
 	if err == io.EOF {
 		return 0, err
 	}
@@ -58,12 +71,8 @@ func (self *FileReader) ReadByte() (byte, error) {
 		return 0, errors.NewErr(err)
 	}
 
-	if n != 1 {
-		return 0, errors.New("Read " + strconv.Itoa(n) + " bytes, instead of one!")
-	}
-
 	self.offset += 1
-	return self.buf[0], nil
+	return b, nil
 }
 
 func (self *FileReader) UnreadByte() error {
@@ -71,7 +80,9 @@ func (self *FileReader) UnreadByte() error {
 		return nil
 	}
 
-	if _, err := self.Seek(int64(self.offset-1), 0); err != nil {
+	// bufio can unread only right after a read
+	if err := self.reader.UnreadByte(); err != nil {
+		_, err := self.Seek(int64(self.offset-1), io.SeekStart)
 		return err
 	}
 	self.offset -= 1
@@ -87,6 +98,12 @@ func (self *FileReader) Write(b []byte) (n int, err error) {
 }
 
 func (self *FileReader) ReadLenval() (uint64, []byte, error) {
+	return self.ReadLenvalMax(math.MaxUint64)
+}
+
+// ReadLenvalMax is ReadLenval failing on values longer than max, so a broken
+// length doesn't make us allocate gigabytes.
+func (self *FileReader) ReadLenvalMax(max uint64) (uint64, []byte, error) {
 	start := self.offset
 	l, err := binary.ReadUvarint(self)
 	diff := self.offset - start
@@ -97,15 +114,19 @@ func (self *FileReader) ReadLenval() (uint64, []byte, error) {
 		return diff, nil, errors.NewErr(err)
 	}
 
+	if l > max {
+		return diff, nil, errors.New("Value of " + strconv.FormatUint(l, 10) + " bytes is longer than " + strconv.FormatUint(max, 10) + "!")
+	}
+
 	res := make([]byte, l)
-	n, err := self.Read(res)
+	n, err := io.ReadFull(self, res)
 	diff += uint64(n)
+	if err == io.ErrUnexpectedEOF {
+		return diff, nil, errors.New("Read " + strconv.Itoa(n) + " bytes, instead of " + strconv.Itoa(int(l)) + "!")
+	}
 	if err != nil {
 		return diff, nil, err
 	}
-	if n != int(l) {
-		return diff, nil, errors.New("Read " + strconv.Itoa(n) + " bytes, instead of " + strconv.Itoa(int(l)) + "!")
-	}
 
 	return diff, res, nil
 }
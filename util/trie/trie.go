@@ -1,72 +1,377 @@
 package trie
 
-type nodeT struct {
-	val  interface{}
-	next map[byte]*nodeT
+import (
+	"bytes"
+	"sort"
+)
+
+// nodeT is a node of a radix tree: label is the part of the key on the edge
+// from the parent, next is sorted by the first byte of the labels, which are
+// all different.
+type nodeT[V any] struct {
+	label string
+	val   V
+	set   bool
+	next  []*nodeT[V]
 }
 
-func (self *nodeT) Add(key []byte, val interface{}, n int) (interface{}, uint) {
-	if n == len(key) {
-		res := self.val
-		self.val = val
-		return res, 0
+func commonPrefix(a []byte, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
 	}
+	return n
+}
 
-	b := key[n]
-	if self.next == nil {
-		t := nodeT{}
-		res, cnt := t.Add(key, val, n+1)
-		self.next = map[byte]*nodeT{
-			b: &t,
-		}
-		return res, cnt + 1
+// child returns the index of the child starting with b, or where to insert it.
+func (self *nodeT[V]) child(b byte) (int, bool) {
+	i := sort.Search(len(self.next), func(i int) bool {
+		return self.next[i].label[0] >= b
+	})
+	return i, i < len(self.next) && self.next[i].label[0] == b
+}
+
+func (self *nodeT[V]) insert(i int, t *nodeT[V]) {
+	self.next = append(self.next, nil)
+	copy(self.next[i+1:], self.next[i:])
+	self.next[i] = t
+}
+
+func (self *nodeT[V]) remove(i int) {
+	copy(self.next[i:], self.next[i+1:])
+	self.next[len(self.next)-1] = nil
+	self.next = self.next[:len(self.next)-1]
+	if len(self.next) == 0 {
+		self.next = nil
+	}
+}
+
+func (self *nodeT[V]) Add(key []byte, val V) (V, bool, uint) {
+	if len(key) == 0 {
+		res, ok := self.val, self.set
+		self.val, self.set = val, true
+		return res, ok, 0
 	}
 
-	t, ok := self.next[b]
-	if ok {
-		return t.Add(key, val, n+1)
-	} else {
-		t := nodeT{}
-		res, cnt := t.Add(key, val, n+1)
-		self.next[b] = &t
-		return res, cnt + 1
+	i, ok := self.child(key[0])
+	if !ok {
+		self.insert(i, &nodeT[V]{
+			label: string(key),
+			val:   val,
+			set:   true,
+		})
+		var zero V
+		return zero, false, 1
+	}
+
+	t := self.next[i]
+	n := commonPrefix(key, t.label)
+	if n == len(t.label) {
+		return t.Add(key[n:], val)
 	}
 
+	// the key leaves the label in the middle, split the edge
+	mid := &nodeT[V]{
+		label: t.label[:n],
+		next:  []*nodeT[V]{t},
+	}
+	t.label = t.label[n:]
+	self.next[i] = mid
+	res, ok, cnt := mid.Add(key[n:], val)
+	return res, ok, cnt + 1
 }
 
-func (self *nodeT) Find(key []byte, n int) (interface{}, bool) {
-	if n == len(key) {
-		if self.val != nil {
-			return self.val, true
-		} else {
-			return nil, false
+func (self *nodeT[V]) Find(key []byte) (V, bool) {
+	for len(key) != 0 {
+		i, ok := self.child(key[0])
+		if !ok {
+			var zero V
+			return zero, false
+		}
+
+		t := self.next[i]
+		if commonPrefix(key, t.label) != len(t.label) {
+			var zero V
+			return zero, false
 		}
+		key = key[len(t.label):]
+		self = t
 	}
+	return self.val, self.set
+}
+
+func (self *nodeT[V]) Delete(key []byte) (V, bool, uint) {
+	var zero V
+	if len(key) == 0 {
+		if !self.set {
+			return zero, false, 0
+		}
 
-	if self.next == nil {
-		return nil, false
+		res := self.val
+		self.val, self.set = zero, false
+		return res, true, 0
 	}
 
-	b := key[n]
-	t, ok := self.next[b]
+	i, ok := self.child(key[0])
 	if !ok {
-		return nil, false
+		return zero, false, 0
+	}
+
+	t := self.next[i]
+	if commonPrefix(key, t.label) != len(t.label) {
+		return zero, false, 0
 	}
 
-	return t.Find(key, n+1)
+	res, ok, cnt := t.Delete(key[len(t.label):])
+	if !ok || t.set {
+		return res, ok, cnt
+	}
+
+	// t has no value anymore, drop it or merge it with its only child
+	switch len(t.next) {
+	case 0:
+		self.remove(i)
+		cnt += 1
+	case 1:
+		c := t.next[0]
+		c.label = t.label + c.label
+		self.next[i] = c
+		cnt += 1
+	}
+	return res, ok, cnt
+}
+
+func (self *nodeT[V]) Walk(key []byte, fn func([]byte, V) bool) bool {
+	if self.set && !fn(key, self.val) {
+		return false
+	}
+
+	return self.walkNext(key, fn)
+}
+
+func (self *nodeT[V]) walkNext(key []byte, fn func([]byte, V) bool) bool {
+	for _, t := range self.next {
+		if !t.Walk(append(key, t.label...), fn) {
+			return false
+		}
+	}
+	return true
+}
+
+// WalkAfter is Walk for keys greater than after, key is a prefix of after.
+func (self *nodeT[V]) WalkAfter(key, after []byte, fn func([]byte, V) bool) bool {
+	rest := after[len(key):]
+	if len(rest) == 0 {
+		// the node of after itself, only its children are greater
+		return self.walkNext(key, fn)
+	}
+
+	for _, t := range self.next {
+		switch {
+		case commonPrefix(rest, t.label) == len(t.label):
+			if !t.WalkAfter(append(key, t.label...), after, fn) {
+				return false
+			}
+		case bytes.Compare([]byte(t.label), rest) > 0:
+			if !t.Walk(append(key, t.label...), fn) {
+				return false
+			}
+		}
+	}
+	return true
 }
 
-type Trie struct {
-	root  nodeT
+// Trie.Count is the number of nodes, Keys is the number of keys. Nodes are
+// created only where keys branch, so Count is at most 2*Keys.
+type Trie[V any] struct {
+	root  nodeT[V]
 	Count uint
+	Keys  uint
 }
 
-func (self *Trie) Add(key []byte, val interface{}) interface{} {
-	res, cnt := self.root.Add(key, val, 0)
+// Add sets val to key and returns the previous value of key, if any.
+func (self *Trie[V]) Add(key []byte, val V) (V, bool) {
+	res, ok, cnt := self.root.Add(key, val)
 	self.Count += cnt
-	return res
+	if !ok {
+		self.Keys += 1
+	}
+	return res, ok
+}
+
+func (self *Trie[V]) Find(key []byte) (V, bool) {
+	return self.root.Find(key)
+}
+
+func (self *Trie[V]) Delete(key []byte) (V, bool) {
+	res, ok, cnt := self.root.Delete(key)
+	self.Count -= cnt
+	if ok {
+		self.Keys -= 1
+	}
+	return res, ok
+}
+
+// Walk calls fn for every key starting with prefix in lexicographic order
+// until fn returns false. The key slice is reused, copy it to keep it.
+func (self *Trie[V]) Walk(prefix []byte, fn func(key []byte, val V) bool) {
+	n := &self.root
+	key := []byte{}
+	for len(prefix) != 0 {
+		i, ok := n.child(prefix[0])
+		if !ok {
+			return
+		}
+
+		t := n.next[i]
+		key = append(key, t.label...)
+		if len(t.label) >= len(prefix) {
+			// the prefix ends on the edge to t
+			if commonPrefix(prefix, t.label) == len(prefix) {
+				t.Walk(key, fn)
+			}
+			return
+		}
+		if commonPrefix(prefix, t.label) != len(t.label) {
+			return
+		}
+		prefix = prefix[len(t.label):]
+		n = t
+	}
+
+	n.Walk(key, fn)
+}
+
+// WalkAfter is Walk for the keys starting with prefix that are greater than
+// after. Subtrees before after are skipped without visiting them.
+func (self *Trie[V]) WalkAfter(prefix, after []byte, fn func(key []byte, val V) bool) {
+	if bytes.Compare(after, prefix) < 0 {
+		self.Walk(prefix, fn)
+		return
+	}
+
+	// every key with the prefix is less than after
+	if !bytes.HasPrefix(after, prefix) {
+		return
+	}
+
+	self.root.WalkAfter(make([]byte, 0, len(after)), after, func(key []byte, val V) bool {
+		if !bytes.HasPrefix(key, prefix) {
+			return false
+		}
+		return fn(key, val)
+	})
+}
+
+// LongestPrefix returns the longest key in the trie that is a prefix of key.
+func (self *Trie[V]) LongestPrefix(key []byte) ([]byte, V, bool) {
+	n := &self.root
+	res, val, ok := 0, n.val, n.set
+	for depth := 0; depth < len(key); {
+		i, found := n.child(key[depth])
+		if !found {
+			break
+		}
+
+		t := n.next[i]
+		if commonPrefix(key[depth:], t.label) != len(t.label) {
+			break
+		}
+		depth += len(t.label)
+		n = t
+		if n.set {
+			res, val, ok = depth, n.val, true
+		}
+	}
+
+	if !ok {
+		return nil, val, false
+	}
+	return key[:res], val, true
+}
+
+type frameT[V any] struct {
+	node    *nodeT[V]
+	depth   int
+	visited bool
+	next    int
+}
+
+// Iterator goes over the keys in lexicographic order. The trie must not be
+// changed while it is used.
+type Iterator[V any] struct {
+	stack []frameT[V]
+	key   []byte
+	val   V
+}
+
+// Seek returns an iterator positioned before the first key not less than key.
+func (self *Trie[V]) Seek(key []byte) *Iterator[V] {
+	res := &Iterator[V]{}
+	n, rest := &self.root, key
+	for {
+		if len(rest) == 0 {
+			res.stack = append(res.stack, frameT[V]{node: n, depth: len(res.key)})
+			return res
+		}
+
+		// n itself is a proper prefix of key, so it is less
+		f := frameT[V]{node: n, depth: len(res.key), visited: true}
+		i, ok := n.child(rest[0])
+		f.next = i
+		if !ok {
+			res.stack = append(res.stack, f)
+			return res
+		}
+
+		t := n.next[i]
+		if commonPrefix(rest, t.label) != len(t.label) {
+			if bytes.Compare([]byte(t.label), rest) < 0 {
+				f.next = i + 1
+			}
+			res.stack = append(res.stack, f)
+			return res
+		}
+
+		f.next = i + 1
+		res.stack = append(res.stack, f)
+		res.key = append(res.key, t.label...)
+		n, rest = t, rest[len(t.label):]
+	}
+}
+
+// Next moves to the next key, it returns false when there are no more.
+func (self *Iterator[V]) Next() bool {
+	for len(self.stack) != 0 {
+		f := &self.stack[len(self.stack)-1]
+		if !f.visited {
+			f.visited = true
+			if f.node.set {
+				self.key = self.key[:f.depth]
+				self.val = f.node.val
+				return true
+			}
+			continue
+		}
+
+		if f.next == len(f.node.next) {
+			self.stack = self.stack[:len(self.stack)-1]
+			continue
+		}
+
+		t := f.node.next[f.next]
+		f.next += 1
+		self.key = append(self.key[:f.depth], t.label...)
+		self.stack = append(self.stack, frameT[V]{node: t, depth: len(self.key)})
+	}
+	return false
+}
+
+// Key is reused by Next, copy it to keep it.
+func (self *Iterator[V]) Key() []byte {
+	return self.key
 }
 
-func (self *Trie) Find(key []byte) (interface{}, bool) {
-	return self.root.Find(key, 0)
+func (self *Iterator[V]) Value() V {
+	return self.val
 }
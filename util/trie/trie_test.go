@@ -0,0 +1,414 @@
+package trie
+
+import (
+	"fmt"
+	"math/rand"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// checkNodes checks the radix invariants under n and returns the number of
+// nodes: labels are not empty, children are sorted by their distinct first
+// bytes, and a node without a value has at least two children.
+func checkNodes[V any](t *testing.T, n *nodeT[V], root bool) uint {
+	if !root && n.label == "" {
+		t.Fatal("Empty label")
+	}
+	if !root && !n.set && len(n.next) < 2 {
+		t.Fatalf("Node %q without a value has %v children", n.label, len(n.next))
+	}
+
+	cnt := uint(0)
+	for i, c := range n.next {
+		if i > 0 && n.next[i-1].label[0] >= c.label[0] {
+			t.Fatalf("Children %q and %q are out of order", n.next[i-1].label, c.label)
+		}
+		cnt += 1 + checkNodes(t, c, false)
+	}
+	return cnt
+}
+
+// checkMap compares the trie with the map it must hold.
+func checkMap(t *testing.T, tr *Trie[int], m map[string]int) {
+	if tr.Keys != uint(len(m)) {
+		t.Fatal("Keys", tr.Keys, "want", len(m))
+	}
+	if cnt := checkNodes(t, &tr.root, true); cnt != tr.Count {
+		t.Fatal("Count", tr.Count, "want", cnt)
+	}
+	if tr.Count > 2*tr.Keys {
+		t.Fatal("Count", tr.Count, "for", tr.Keys, "keys")
+	}
+
+	want := make([]string, 0, len(m))
+	for k := range m {
+		want = append(want, k)
+	}
+	sort.Strings(want)
+
+	got := []string{}
+	tr.Walk(nil, func(key []byte, val int) bool {
+		if m[string(key)] != val {
+			t.Fatalf("Walk %q = %v, want %v", key, val, m[string(key)])
+		}
+		got = append(got, string(key))
+		return true
+	})
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatal("Walk", got, "want", want)
+	}
+}
+
+// randKey makes short keys of few letters, so they share prefixes a lot.
+func randKey(r *rand.Rand) []byte {
+	key := make([]byte, r.Intn(7))
+	for i := range key {
+		key[i] = "abc"[r.Intn(3)]
+	}
+	return key
+}
+
+// TestTrieMap runs random Add, Delete and Find on the trie and a map.
+func TestTrieMap(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	tr := &Trie[int]{}
+	m := map[string]int{}
+	for i := 0; i < 20000; i++ {
+		key := randKey(r)
+		want, wantOk := m[string(key)]
+		switch r.Intn(3) {
+		case 0:
+			if val, ok := tr.Add(key, i); ok != wantOk || val != want {
+				t.Fatalf("Add %q = %v %v, want %v %v", key, val, ok, want, wantOk)
+			}
+			m[string(key)] = i
+		case 1:
+			if val, ok := tr.Delete(key); ok != wantOk || val != want {
+				t.Fatalf("Delete %q = %v %v, want %v %v", key, val, ok, want, wantOk)
+			}
+			delete(m, string(key))
+		default:
+			if val, ok := tr.Find(key); ok != wantOk || val != want {
+				t.Fatalf("Find %q = %v %v, want %v %v", key, val, ok, want, wantOk)
+			}
+		}
+
+		if i%100 == 0 {
+			checkMap(t, tr, m)
+		}
+	}
+	checkMap(t, tr, m)
+
+	for k := range m {
+		tr.Delete([]byte(k))
+	}
+	if tr.Keys != 0 || tr.Count != 0 || len(tr.root.next) != 0 {
+		t.Fatal("Not empty", tr.Keys, tr.Count)
+	}
+}
+
+// TestDeleteMerges checks that a node left without a value and with one
+// child is merged with it, and one without children is removed.
+func TestDeleteMerges(t *testing.T) {
+	tr := &Trie[int]{}
+	tr.Add([]byte("abc"), 1)
+	tr.Add([]byte("abd"), 2)
+	tr.Add([]byte("ab"), 3)
+	// ab -> c, d
+	if tr.Count != 3 {
+		t.Fatal("Count", tr.Count)
+	}
+
+	tr.Delete([]byte("abd"))
+	// ab -> c
+	if tr.Count != 2 {
+		t.Fatal("Count", tr.Count)
+	}
+
+	tr.Delete([]byte("ab"))
+	// abc
+	if tr.Count != 1 || len(tr.root.next) != 1 || tr.root.next[0].label != "abc" {
+		t.Fatal("Not merged", tr.Count)
+	}
+	if val, ok := tr.Find([]byte("abc")); !ok || val != 1 {
+		t.Fatal("Find", val, ok)
+	}
+
+	if _, ok := tr.Delete([]byte("ab")); ok {
+		t.Fatal("Deleted a missing key")
+	}
+	tr.Delete([]byte("abc"))
+	if tr.Count != 0 || len(tr.root.next) != 0 {
+		t.Fatal("Not removed", tr.Count)
+	}
+}
+
+// randTrie fills a trie and a map with the same random keys.
+func randTrie(r *rand.Rand, n int) (*Trie[int], []string) {
+	tr := &Trie[int]{}
+	m := map[string]bool{}
+	for i := 0; i < n; i++ {
+		key := randKey(r)
+		tr.Add(key, len(key))
+		m[string(key)] = true
+	}
+
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return tr, keys
+}
+
+// TestWalk checks Walk and WalkAfter against the sorted keys, with early
+// stops.
+func TestWalk(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	tr, keys := randTrie(r, 300)
+	for i := 0; i < 1000; i++ {
+		prefix, after := randKey(r), randKey(r)
+		limit := r.Intn(10)
+
+		want, wantAfter := []string{}, []string{}
+		for _, k := range keys {
+			if !strings.HasPrefix(k, string(prefix)) {
+				continue
+			}
+			if len(want) < limit {
+				want = append(want, k)
+			}
+			if k > string(after) && len(wantAfter) < limit {
+				wantAfter = append(wantAfter, k)
+			}
+		}
+
+		collect := func(res *[]string) func([]byte, int) bool {
+			return func(key []byte, val int) bool {
+				if val != len(key) {
+					t.Fatalf("Value of %q is %v", key, val)
+				}
+				*res = append(*res, string(key))
+				return len(*res) < limit
+			}
+		}
+		got, gotAfter := []string{}, []string{}
+		if limit != 0 {
+			tr.Walk(prefix, collect(&got))
+			tr.WalkAfter(prefix, after, collect(&gotAfter))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("Walk(%q) %v, want %v", prefix, got, want)
+		}
+		if fmt.Sprint(gotAfter) != fmt.Sprint(wantAfter) {
+			t.Fatalf("WalkAfter(%q, %q) %v, want %v", prefix, after, gotAfter, wantAfter)
+		}
+	}
+}
+
+// TestSeek checks that the iterator goes over the keys not less than the
+// sought one in order.
+func TestSeek(t *testing.T) {
+	r := rand.New(rand.NewSource(3))
+	tr, keys := randTrie(r, 300)
+	for i := 0; i < 1000; i++ {
+		from := randKey(r)
+		want := []string{}
+		for _, k := range keys {
+			if k >= string(from) {
+				want = append(want, k)
+			}
+		}
+
+		got := []string{}
+		for it := tr.Seek(from); it.Next(); {
+			if it.Value() != len(it.Key()) {
+				t.Fatalf("Value of %q is %v", it.Key(), it.Value())
+			}
+			got = append(got, string(it.Key()))
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("Seek(%q) %v, want %v", from, got, want)
+		}
+	}
+
+	if (&Trie[int]{}).Seek(nil).Next() {
+		t.Fatal("Next in an empty trie")
+	}
+}
+
+// TestLongestPrefix matches host keys as the TTL rules do.
+func TestLongestPrefix(t *testing.T) {
+	tr := &Trie[int]{}
+	for i, k := range []string{"ru.", "ru.lenta.", "ru.lenta.news.", "com.google."} {
+		tr.Add([]byte(k), i)
+	}
+
+	check := func(key, want string, ok bool) {
+		t.Helper()
+		got, val, found := tr.LongestPrefix([]byte(key))
+		if found != ok || string(got) != want {
+			t.Fatalf("LongestPrefix(%q) = %q %v, want %q %v", key, got, found, want, ok)
+		}
+		if found {
+			if v, _ := tr.Find(got); v != val {
+				t.Fatalf("LongestPrefix(%q) value %v, want %v", key, val, v)
+			}
+		}
+	}
+	check("ru.lenta.news.sport.", "ru.lenta.news.", true)
+	check("ru.lenta.news.", "ru.lenta.news.", true)
+	// the key ends inside an edge
+	check("ru.lenta.n", "ru.lenta.", true)
+	check("ru.lentaa.", "ru.", true)
+	check("com.", "", false)
+	check("", "", false)
+
+	// the empty key is a prefix of everything
+	tr.Add(nil, 10)
+	check("com.", "", true)
+	check("com.google.mail.", "com.google.", true)
+}
+
+// mapNode is the trie before the radix one: a node with a map for every
+// byte of every key.
+type mapNode struct {
+	val  interface{}
+	next map[byte]*mapNode
+}
+
+func (self *mapNode) Add(key []byte, val interface{}) {
+	for _, b := range key {
+		if self.next == nil {
+			self.next = map[byte]*mapNode{}
+		}
+		t, ok := self.next[b]
+		if !ok {
+			t = &mapNode{}
+			self.next[b] = t
+		}
+		self = t
+	}
+	self.val = val
+}
+
+func (self *mapNode) Find(key []byte) bool {
+	for _, b := range key {
+		t, ok := self.next[b]
+		if !ok {
+			return false
+		}
+		self = t
+	}
+	return self.val != nil
+}
+
+var words = []string{"news", "blog", "forum", "shop", "wiki", "auto", "sport", "photo", "music", "habrahabr",
+	"lenta", "market", "travel", "kino", "games", "realty", "job", "health", "tech", "food"}
+var zones = []string{"ru", "com", "org", "net", "ua", "info", "su"}
+
+// benchKeys makes n keys like the gatekeeper holds for the urls the spider
+// sees: many hosts reversed, subdomains, dated articles, pages and query
+// strings.
+func benchKeys(n int) [][]byte {
+	r := rand.New(rand.NewSource(1))
+	hosts := make([]string, n/50+1)
+	for i := range hosts {
+		host := fmt.Sprintf("%v.%v%v", zones[r.Intn(len(zones))], words[r.Intn(len(words))], r.Intn(10000))
+		switch r.Intn(3) {
+		case 0:
+			host += ".www"
+		case 1:
+			host += "." + words[r.Intn(len(words))]
+		}
+		hosts[i] = host
+	}
+
+	res := make([][]byte, n)
+	for i := range res {
+		host := hosts[r.Intn(len(hosts))]
+		switch r.Intn(4) {
+		case 0:
+			res[i] = []byte(fmt.Sprintf("http://%v/%v/%v/%02d/%v-%v.html", host, words[r.Intn(len(words))], 2010+r.Intn(5), 1+r.Intn(12), words[r.Intn(len(words))], r.Intn(1000000)))
+		case 1:
+			res[i] = []byte(fmt.Sprintf("http://%v/post/%v/", host, r.Intn(300000)))
+		case 2:
+			res[i] = []byte(fmt.Sprintf("http://%v/%v/?page=%v&sort=%v", host, words[r.Intn(len(words))], r.Intn(100), words[r.Intn(len(words))]))
+		default:
+			res[i] = []byte(fmt.Sprintf("http://%v/", host))
+		}
+	}
+	return res
+}
+
+const benchKeysNum = 100000
+
+// heapOf returns the heap held by what build makes.
+func heapOf(build func() interface{}) uint64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	res := build()
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(res)
+	return after.HeapAlloc - before.HeapAlloc
+}
+
+// BenchmarkTrie compares the radix trie with the map per byte one it
+// replaced on url keys, bytes/key is the heap held:
+//
+//	go test -run - -bench Trie psearch/util/trie
+func BenchmarkTrie(b *testing.B) {
+	keys := benchKeys(benchKeysNum)
+	// every key has a pointer value, as in the gatekeeper
+	val := &struct{}{}
+
+	buildMap := func() interface{} {
+		res := &mapNode{}
+		for _, k := range keys {
+			res.Add(k, val)
+		}
+		return res
+	}
+	buildRadix := func() interface{} {
+		res := &Trie[*struct{}]{}
+		for _, k := range keys {
+			res.Add(k, val)
+		}
+		return res
+	}
+
+	for _, c := range []struct {
+		name  string
+		build func() interface{}
+	}{{"map", buildMap}, {"radix", buildRadix}} {
+		b.Run(c.name+"-add", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				c.build()
+			}
+			b.ReportMetric(float64(heapOf(c.build))/float64(len(keys)), "bytes/key")
+		})
+	}
+
+	b.Run("map-find", func(b *testing.B) {
+		m := buildMap().(*mapNode)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if !m.Find(keys[i%len(keys)]) {
+				b.Fatal("Lost", string(keys[i%len(keys)]))
+			}
+		}
+	})
+	b.Run("radix-find", func(b *testing.B) {
+		tr := buildRadix().(*Trie[*struct{}])
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, ok := tr.Find(keys[i%len(keys)]); !ok {
+				b.Fatal("Lost", string(keys[i%len(keys)]))
+			}
+		}
+	})
+}